@@ -37,6 +37,10 @@ func Start() error {
 			iCli.BridgeCMD(toolName),
 			&iCli.GetKubeConfigCMD,
 			&iCli.RoleCMD,
+			&iCli.NodeCMD,
+			&iCli.OperatorKeyCMD,
+			&iCli.ClusterCMD,
+			&iCli.TokenCMD,
 			&iCli.CreateConfigCMD,
 			&iCli.GenerateTokenCMD,
 			&iCli.ValidateSchemaCMD,
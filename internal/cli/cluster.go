@@ -0,0 +1,148 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kairos-io/provider-kairos/v2/internal/cluster"
+	"github.com/kairos-io/provider-kairos/v2/internal/events"
+	edgeVPNClient "github.com/mudler/edgevpn/api/client"
+	"github.com/mudler/edgevpn/api/client/service"
+	"github.com/urfave/cli/v2"
+)
+
+var followInterval = 5 * time.Second
+
+// newEvents returns the events not printed yet, tracking the last one seen for each node.
+func newEvents(all []events.Event, seen map[string]time.Time) []events.Event {
+	res := []events.Event{}
+	for _, e := range all {
+		if last, ok := seen[e.UUID]; ok && !e.Time.After(last) {
+			continue
+		}
+		res = append(res, e)
+	}
+	for _, e := range res {
+		if e.Time.After(seen[e.UUID]) {
+			seen[e.UUID] = e.Time
+		}
+	}
+	return res
+}
+
+func printEvents(w io.Writer, list []events.Event, header bool) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if header {
+		fmt.Fprintln(tw, "TIME\tNODE\tROLE\tSTEP\tOUTCOME\tERROR")
+	}
+	for _, e := range list {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", e.Time.Local().Format(time.RFC3339), e.UUID, e.Role, e.Step, e.Outcome, e.Error)
+	}
+	tw.Flush()
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func printStatus(w io.Writer, s cluster.Status) {
+	fmt.Fprintf(w, "Network:    %s\n", s.NetworkID)
+	fmt.Fprintf(w, "Leader:     %s\n", s.Leader)
+	fmt.Fprintf(w, "Master IP:  %s\n", s.MasterIP)
+	fmt.Fprintf(w, "Kubeconfig: %s\n\n", yesNo(s.Kubeconfig))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tHOSTNAME\tROLE\tLIVENESS\tVPN IP\tBOOTSTRAPPED")
+	for _, n := range s.Nodes {
+		liveness := "active"
+		switch {
+		case !n.Advertizing:
+			liveness = "gone"
+		case !n.Active:
+			liveness = "inactive"
+		}
+		uuid := n.UUID
+		if n.Leader {
+			uuid += " (leader)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", uuid, n.Hostname, n.Role, liveness, n.VPNIP, yesNo(n.Bootstrapped))
+	}
+	tw.Flush()
+
+	if len(s.Warnings) > 0 {
+		fmt.Fprintln(w)
+	}
+	for _, warning := range s.Warnings {
+		fmt.Fprintf(w, "WARNING: %s\n", warning)
+	}
+}
+
+var ClusterCMD = cli.Command{
+	Name:  "cluster",
+	Usage: "Inspect the cluster formation",
+	Subcommands: []*cli.Command{
+		{
+			Flags:     append([]cli.Flag{outputFlag}, networkAPI...),
+			Name:      "status",
+			Usage:     "Show the nodes of the network and the cluster formation state",
+			UsageText: "kairos cluster status [--network-id <ID>] [--output table|json|yaml]",
+			Action: func(c *cli.Context) error {
+				cc := service.NewClient(
+					c.String("network-id"),
+					edgeVPNClient.NewClient(edgeVPNClient.WithHost(c.String("api"))))
+				s, err := cluster.GetStatus(cc, c.String("network-id"))
+				if err != nil {
+					return err
+				}
+				return printOutput(os.Stdout, c.String("output"), s, func(w io.Writer) { printStatus(w, s) })
+			},
+		},
+		{
+			Flags: append([]cli.Flag{
+				&cli.BoolFlag{
+					Name:    "follow",
+					Aliases: []string{"f"},
+					Usage:   "Keep printing new events",
+				},
+				&cli.StringFlag{
+					Name:  "node",
+					Usage: "Only show the events of the node with the given UUID",
+				},
+			}, networkAPI...),
+			Name:      "events",
+			Usage:     "Show the bootstrap events published by the nodes",
+			UsageText: "kairos cluster events [--follow] [--node <UUID>]",
+			Description: `
+		Prints the bootstrap steps run by the nodes of the network, as published in the ledger.
+		Each node keeps its last events only.
+		`,
+			Action: func(c *cli.Context) error {
+				client := edgeVPNClient.NewClient(edgeVPNClient.WithHost(c.String("api")))
+				seen := map[string]time.Time{}
+
+				for header := true; ; header = false {
+					list, err := events.List(client, c.String("network-id"), c.String("node"))
+					if err != nil {
+						return fmt.Errorf("could not read events: %w", err)
+					}
+					printEvents(os.Stdout, newEvents(list, seen), header)
+
+					if !c.Bool("follow") {
+						return nil
+					}
+					select {
+					case <-c.Context.Done():
+						return nil
+					case <-time.After(followInterval):
+					}
+				}
+			},
+		},
+	},
+}
@@ -58,5 +58,37 @@ fooz: "bar"
 			hasHeader, _ := config.HasHeader(string(content), "#node-config")
 			Expect(hasHeader).To(BeTrue(), string(content))
 		})
+
+		It("replace token of additional networks in config files", func() {
+			var cc string = `#cloud-config
+p2p:
+  network_token: "foo"
+  networks:
+  - name: mgmt
+    network_token: "bar"
+`
+			d, _ := ioutil.TempDir("", "xxxx")
+			defer os.RemoveAll(d)
+
+			err := ioutil.WriteFile(filepath.Join(d, "test"), []byte(cc), os.ModePerm)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = ReplaceNetworkToken([]string{d}, "mgmt", "baz")
+			Expect(err).ToNot(HaveOccurred())
+
+			content, err := ioutil.ReadFile(filepath.Join(d, "test"))
+			Expect(err).ToNot(HaveOccurred())
+
+			res := map[string]interface{}{}
+			err = yaml.Unmarshal(content, &res)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(res["p2p"]).To(Equal(map[string]interface{}{
+				"network_token": "foo",
+				"networks": []interface{}{
+					map[string]interface{}{"name": "mgmt", "network_token": "baz"},
+				},
+			}))
+		})
 	})
 })
@@ -0,0 +1,241 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+var createConfigFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "distribution",
+		Usage: "Kubernetes distribution: k3s, formed automatically over P2P, or k0s",
+		Value: "k3s",
+	},
+	&cli.BoolFlag{
+		Name:  "ha",
+		Usage: "Create an HA control plane",
+	},
+	&cli.IntFlag{
+		Name:  "master-nodes",
+		Usage: "Number of HA masters next to the cluster init one (implies --ha)",
+	},
+	&cli.StringFlag{
+		Name:  "external-db",
+		Usage: "External datastore endpoint of the HA control plane, instead of the embedded etcd",
+	},
+	&cli.StringFlag{
+		Name:  "kubevip-eip",
+		Usage: "Enable kube-vip with the given floating IP for the Kubernetes API",
+	},
+	&cli.StringFlag{
+		Name:  "kubevip-interface",
+		Usage: "Interface kube-vip announces the floating IP on",
+	},
+	&cli.BoolFlag{
+		Name:  "dns",
+		Usage: "Enable the P2P DNS server",
+	},
+	&cli.StringFlag{
+		Name:  "role",
+		Usage: "Static role of the node: master or worker",
+	},
+	&cli.IntFlag{
+		Name:  "minimum-nodes",
+		Usage: "Nodes required before roles are scheduled",
+	},
+	&cli.BoolFlag{
+		Name:  "vpn-create",
+		Usage: "Create the VPN",
+		Value: true,
+	},
+	&cli.BoolFlag{
+		Name:  "vpn-use",
+		Usage: "Use the VPN for the Kubernetes network",
+		Value: true,
+	},
+	&cli.StringFlag{
+		Name:  "output-dir",
+		Usage: "Write one config per node type in the given directory, sharing the same token",
+	},
+}
+
+// clusterOptions describe the cluster a config is generated for.
+type clusterOptions struct {
+	Token            string
+	NetworkID        string
+	Distribution     string
+	HA               bool
+	MasterNodes      int
+	ExternalDB       string
+	KubeVIPEIP       string
+	KubeVIPInterface string
+	DNS              bool
+	Role             string
+	MinimumNodes     int
+	VPNCreate        bool
+	VPNUse           bool
+}
+
+func clusterOptionsFromFlags(c *cli.Context, token, networkID string) clusterOptions {
+	return clusterOptions{
+		Token:            token,
+		NetworkID:        networkID,
+		Distribution:     c.String("distribution"),
+		HA:               c.Bool("ha") || c.Int("master-nodes") > 0,
+		MasterNodes:      c.Int("master-nodes"),
+		ExternalDB:       c.String("external-db"),
+		KubeVIPEIP:       c.String("kubevip-eip"),
+		KubeVIPInterface: c.String("kubevip-interface"),
+		DNS:              c.Bool("dns"),
+		Role:             c.String("role"),
+		MinimumNodes:     c.Int("minimum-nodes"),
+		VPNCreate:        c.Bool("vpn-create"),
+		VPNUse:           c.Bool("vpn-use"),
+	}
+}
+
+// validate checks the flag combinations, the config itself is validated once generated.
+func (o clusterOptions) validate() error {
+	switch o.Distribution {
+	case "k3s":
+	case "k0s":
+		if o.HA || o.ExternalDB != "" {
+			return errors.New("HA control planes are formed automatically with k3s only")
+		}
+	default:
+		return fmt.Errorf("unknown distribution '%s', k3s or k0s are supported", o.Distribution)
+	}
+
+	if o.Role != "" && o.Role != "master" && o.Role != "worker" {
+		return fmt.Errorf("invalid role '%s', master or worker are supported", o.Role)
+	}
+	if o.MasterNodes < 0 || o.MinimumNodes < 0 {
+		return errors.New("node counts can't be negative")
+	}
+	if o.ExternalDB != "" && !o.HA {
+		return errors.New("an external datastore requires --ha")
+	}
+	if o.HA && o.MasterNodes == 0 {
+		return errors.New("--ha requires --master-nodes")
+	}
+	if o.KubeVIPInterface != "" && o.KubeVIPEIP == "" {
+		return errors.New("--kubevip-interface requires --kubevip-eip")
+	}
+	if o.VPNUse && !o.VPNCreate {
+		return errors.New("the VPN can't be used for Kubernetes without creating it")
+	}
+	return nil
+}
+
+// nodeTypes returns the roles a config is generated for with --output-dir.
+func (o clusterOptions) nodeTypes() []string {
+	switch {
+	case o.Distribution == "k3s" && o.HA:
+		return []string{"master/clusterinit", "master/ha", "worker"}
+	default:
+		return []string{"master", "worker"}
+	}
+}
+
+// config returns the config of the nodes with the given role, or of any node if empty.
+func (o clusterOptions) config(role string) (*providerConfig.Config, error) {
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	if role == "" {
+		role = o.Role
+	}
+
+	p2p := &providerConfig.P2P{
+		NetworkToken: o.Token,
+		NetworkID:    o.NetworkID,
+		MinimumNodes: o.MinimumNodes,
+		VPN: providerConfig.VPN{
+			Create: &o.VPNCreate,
+			Use:    &o.VPNUse,
+		},
+	}
+	// Leave the VPN settings out when they are the defaults
+	if o.VPNCreate && o.VPNUse {
+		p2p.VPN = providerConfig.VPN{}
+	}
+	if o.DNS {
+		enabled := true
+		p2p.DNS = providerConfig.DNS{Enable: &enabled}
+	}
+
+	c := &providerConfig.Config{P2P: p2p}
+	if o.KubeVIPEIP != "" {
+		c.KubeVIP = providerConfig.KubeVIP{EIP: o.KubeVIPEIP, Interface: o.KubeVIPInterface}
+	}
+
+	switch o.Distribution {
+	case "k0s":
+		// k0s is set up once on boot, with the role given by the config
+		disabled := false
+		p2p.Auto = providerConfig.Auto{Enable: &disabled}
+		switch role {
+		case "master":
+			c.K0s = providerConfig.K0s{Enabled: true}
+		case "worker":
+			c.K0sWorker = providerConfig.K0s{Enabled: true}
+		default:
+			return nil, errors.New("k0s requires --role or --output-dir")
+		}
+	default:
+		p2p.Role = role
+		if o.HA {
+			enabled := true
+			masterNodes := o.MasterNodes
+			p2p.Auto.HA = providerConfig.HA{Enable: &enabled, MasterNodes: &masterNodes, ExternalDB: o.ExternalDB}
+			if p2p.MinimumNodes == 0 {
+				p2p.MinimumNodes = masterNodes + 1
+			}
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func cloudConfig(c *providerConfig.Config) (string, error) {
+	y, err := yaml.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("#cloud-config\n\n%s", string(y)), nil
+}
+
+// writeNodeConfigs writes the config of each node type in dir, returning the written files.
+func writeNodeConfigs(o clusterOptions, dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, role := range o.nodeTypes() {
+		c, err := o.config(role)
+		if err != nil {
+			return files, err
+		}
+		content, err := cloudConfig(c)
+		if err != nil {
+			return files, err
+		}
+		path := filepath.Join(dir, strings.ReplaceAll(role, "/", "-")+".yaml")
+		// The config holds the network token
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			return files, err
+		}
+		files = append(files, path)
+	}
+	return files, nil
+}
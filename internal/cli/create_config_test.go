@@ -0,0 +1,89 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+
+	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gopkg.in/yaml.v3"
+)
+
+var _ = Describe("Create config", func() {
+	options := func() clusterOptions {
+		return clusterOptions{Token: "token", Distribution: "k3s", VPNCreate: true, VPNUse: true}
+	}
+
+	It("generates an HA cluster with kube-vip and DNS", func() {
+		o := options()
+		o.HA, o.MasterNodes, o.KubeVIPEIP, o.DNS = true, 2, "10.0.0.10", true
+
+		c, err := o.config("")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.P2P.Auto.HA.IsEnabled()).To(BeTrue())
+		Expect(*c.P2P.Auto.HA.MasterNodes).To(Equal(2))
+		Expect(c.P2P.MinimumNodes).To(Equal(3))
+		Expect(c.P2P.DNS.IsEnabled()).To(BeTrue())
+		Expect(c.KubeVIP.IsEnabled()).To(BeTrue())
+		Expect(c.P2P.UseVPNWithKubernetes()).To(BeTrue())
+
+		// The generated config reads back the same
+		content, err := cloudConfig(c)
+		Expect(err).ToNot(HaveOccurred())
+		read := &providerConfig.Config{}
+		Expect(yaml.Unmarshal([]byte(content), read)).To(Succeed())
+		Expect(read).To(Equal(c))
+	})
+
+	It("rejects inconsistent topologies", func() {
+		for _, change := range []func(*clusterOptions){
+			func(o *clusterOptions) { o.Distribution = "rke2" },
+			func(o *clusterOptions) { o.HA = true },
+			func(o *clusterOptions) { o.ExternalDB = "mysql://db" },
+			func(o *clusterOptions) { o.Distribution, o.HA, o.MasterNodes = "k0s", true, 2 },
+			func(o *clusterOptions) { o.KubeVIPEIP = "not-an-ip" },
+			func(o *clusterOptions) { o.KubeVIPInterface = "eth0" },
+			func(o *clusterOptions) { o.Role = "master/ha" },
+			func(o *clusterOptions) { o.VPNCreate = false },
+		} {
+			o := options()
+			change(&o)
+			_, err := o.config("")
+			Expect(err).To(HaveOccurred(), "%+v", o)
+		}
+	})
+
+	It("writes one config per node type", func() {
+		o := options()
+		o.HA, o.MasterNodes = true, 2
+		dir := GinkgoT().TempDir()
+
+		files, err := writeNodeConfigs(o, dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(files).To(Equal([]string{
+			filepath.Join(dir, "master-clusterinit.yaml"),
+			filepath.Join(dir, "master-ha.yaml"),
+			filepath.Join(dir, "worker.yaml"),
+		}))
+
+		dat, err := os.ReadFile(files[1])
+		Expect(err).ToNot(HaveOccurred())
+		c := &providerConfig.Config{}
+		Expect(yaml.Unmarshal(dat, c)).To(Succeed())
+		Expect(c.P2P.Role).To(Equal("master/ha"))
+		Expect(c.P2P.NetworkToken).To(Equal("token"))
+	})
+
+	It("sets up k0s once with the node role", func() {
+		o := options()
+		o.Distribution = "k0s"
+		_, err := o.config("")
+		Expect(err).To(HaveOccurred())
+
+		c, err := o.config("worker")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.IsK0sWorkerEnabled()).To(BeTrue())
+		Expect(c.P2P.Auto.IsEnabled()).To(BeFalse())
+	})
+})
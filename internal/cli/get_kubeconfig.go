@@ -2,14 +2,92 @@ package cli
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"strings"
+	"os"
 
 	edgeVPNClient "github.com/mudler/edgevpn/api/client"
 	"github.com/mudler/edgevpn/api/client/service"
 	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
 )
 
+// kubeconfigEndpoint returns the host the kubeconfig should point to: the kube-vip address,
+// the master IP, the api.<network-id> DNS name, or the given host. By default the kube-vip
+// address is used when published, the master IP otherwise.
+func kubeconfigEndpoint(cc *service.Client, networkID, endpoint string) (string, error) {
+	vip, _ := cc.Get("master", "vip")
+	masterIP, _ := cc.Get("master", "ip")
+
+	switch endpoint {
+	case "", "auto":
+		if vip != "" {
+			return vip, nil
+		}
+		if masterIP == "" {
+			return "", errors.New("no master IP published yet")
+		}
+		return masterIP, nil
+	case "vip":
+		if vip == "" {
+			return "", errors.New("no kube-vip address published")
+		}
+		return vip, nil
+	case "master":
+		if masterIP == "" {
+			return "", errors.New("no master IP published yet")
+		}
+		return masterIP, nil
+	case "dns":
+		return fmt.Sprintf("api.%s", networkID), nil
+	default:
+		return endpoint, nil
+	}
+}
+
+// fetchKubeconfig returns the kubeconfig published by the master, pointing to the
+// chosen endpoint and named after the network ID.
+func fetchKubeconfig(cc *service.Client, networkID, endpoint string) (kubeconfig, error) {
+	str, _ := cc.Get("kubeconfig", "master")
+	if str == "" {
+		return nil, errors.New("no kubeconfig published yet, with p2p.admission it is only available on the masters")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig published: %w", err)
+	}
+	k, err := parseKubeconfig(b)
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := kubeconfigEndpoint(cc, networkID, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if err := k.rewrite(networkID, host); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// kubeconfigOutput converts the kubeconfig to the requested format.
+func kubeconfigOutput(k kubeconfig, format string) ([]byte, error) {
+	switch format {
+	case "", "yaml":
+		return yaml.Marshal(k)
+	case "json":
+		dat, err := json.MarshalIndent(k, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(dat, '\n'), nil
+	default:
+		return nil, fmt.Errorf("unknown output format '%s'", format)
+	}
+}
+
 var GetKubeConfigCMD = cli.Command{
 	Name:      "get-kubeconfig",
 	Usage:     "Return a deployment kubeconfig",
@@ -22,16 +100,77 @@ var GetKubeConfigCMD = cli.Command{
 		For example:
 		
 		$ kairos get-kubeconfig --network-id kairos
+
+		Use --wait to block until the kubeconfig is published, e.g. while the cluster is forming:
+
+		$ kairos get-kubeconfig --network-id kairos --wait 30m --output json
+
+		Use --merge to add it to $KUBECONFIG or ~/.kube/config, or --output-file to write it to a file:
+
+		$ kairos get-kubeconfig --network-id kairos --endpoint dns --merge
+		$ kairos get-kubeconfig --network-id kairos --output-file kairos.yaml
 		`,
-	Flags: networkAPI,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "Output format (yaml or json)",
+			Value:   "yaml",
+		},
+		&cli.StringFlag{
+			Name:  "output-file",
+			Usage: "File to write the kubeconfig to, instead of printing it",
+		},
+		&cli.StringFlag{
+			Name:  "endpoint",
+			Usage: "API server endpoint: auto, vip, master, dns (api.<network-id>) or a host name",
+			Value: "auto",
+		},
+		&cli.BoolFlag{
+			Name:  "merge",
+			Usage: "Merge the kubeconfig into $KUBECONFIG or ~/.kube/config",
+		},
+		waitFlag,
+	}, networkAPI...),
 	Action: func(c *cli.Context) error {
+		networkID := c.String("network-id")
 		cc := service.NewClient(
-			c.String("network-id"),
+			networkID,
 			edgeVPNClient.NewClient(edgeVPNClient.WithHost(c.String("api"))))
-		str, _ := cc.Get("kubeconfig", "master")
-		b, _ := base64.RawURLEncoding.DecodeString(str)
-		masterIP, _ := cc.Get("master", "ip")
-		fmt.Println(strings.ReplaceAll(string(b), "127.0.0.1", masterIP))
-		return nil
+
+		var k kubeconfig
+		err := waitFor(c.Context, c.Duration("wait"), func() (err error) {
+			k, err = fetchKubeconfig(cc, networkID, c.String("endpoint"))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("network %s: %w", networkID, err)
+		}
+
+		if c.Bool("merge") {
+			path, err := defaultKubeconfigPath()
+			if err != nil {
+				return err
+			}
+			if err := mergeKubeconfigFile(path, k); err != nil {
+				return fmt.Errorf("could not merge kubeconfig: %w", err)
+			}
+			fmt.Fprintf(os.Stderr, "Merged context %s into %s\n", networkID, path)
+		}
+
+		out, err := kubeconfigOutput(k, c.String("output"))
+		if err != nil {
+			return err
+		}
+
+		switch file := c.String("output-file"); {
+		case file != "":
+			if err := writeKubeconfig(file, out); err != nil {
+				return fmt.Errorf("could not write kubeconfig: %w", err)
+			}
+		case !c.Bool("merge"):
+			_, err = os.Stdout.Write(out)
+		}
+		return err
 	},
 }
@@ -0,0 +1,447 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	qr "github.com/kairos-io/go-nodepair/qrcode"
+	"gopkg.in/yaml.v3"
+)
+
+// watchInterval is how often the watched directory is scanned for new images.
+var watchInterval = 2 * time.Second
+
+// defaultConcurrency is how many nodes are registered at the same time, unless set.
+const defaultConcurrency = 4
+
+var imageExtensions = []string{".png", ".jpg", ".jpeg", ".gif"}
+
+// inventoryNode is a node to register, with its overrides of the inventory defaults.
+type inventoryNode struct {
+	Name     string            `yaml:"name,omitempty"`
+	Image    string            `yaml:"image,omitempty"`
+	Config   string            `yaml:"config,omitempty"`
+	Device   string            `yaml:"device,omitempty"`
+	Hostname string            `yaml:"hostname,omitempty"`
+	Role     string            `yaml:"role,omitempty"`
+	Labels   map[string]string `yaml:"labels,omitempty"`
+	Reboot   *bool             `yaml:"reboot,omitempty"`
+	Poweroff *bool             `yaml:"poweroff,omitempty"`
+	Template *bool             `yaml:"template,omitempty"`
+	Values   map[string]string `yaml:"values,omitempty"`
+}
+
+// inventory lists the QR images of the nodes to register, or a directory to watch for them.
+type inventory struct {
+	Defaults    inventoryNode   `yaml:"defaults,omitempty"`
+	Watch       string          `yaml:"watch,omitempty"`
+	Concurrency int             `yaml:"concurrency,omitempty"`
+	Nodes       []inventoryNode `yaml:"nodes,omitempty"`
+}
+
+// registrationResult is the outcome of the registration of a node.
+type registrationResult struct {
+	Name     string
+	Image    string
+	Error    string
+	Duration time.Duration
+}
+
+func readInventory(path string) (*inventory, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	inv := &inventory{}
+	if err := yaml.Unmarshal(dat, inv); err != nil {
+		return nil, fmt.Errorf("invalid inventory '%s': %w", path, err)
+	}
+
+	// Paths are relative to the inventory
+	dir := filepath.Dir(path)
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	inv.Defaults.Config = resolve(inv.Defaults.Config)
+	inv.Watch = resolve(inv.Watch)
+	for i := range inv.Nodes {
+		inv.Nodes[i].Config = resolve(inv.Nodes[i].Config)
+		if inv.Watch == "" {
+			inv.Nodes[i].Image = resolve(inv.Nodes[i].Image)
+		}
+	}
+
+	if inv.Watch == "" && len(inv.Nodes) == 0 {
+		return nil, errors.New("the inventory lists no nodes nor a directory to watch")
+	}
+	for _, n := range inv.Nodes {
+		if n.Image == "" {
+			return nil, fmt.Errorf("no image given for the node '%s'", n.name())
+		}
+	}
+	return inv, nil
+}
+
+// merge returns the node with the unset fields taken from defaults.
+func (n inventoryNode) merge(defaults inventoryNode) inventoryNode {
+	if n.Config == "" {
+		n.Config = defaults.Config
+	}
+	if n.Device == "" {
+		n.Device = defaults.Device
+	}
+	if n.Hostname == "" {
+		n.Hostname = defaults.Hostname
+	}
+	if n.Role == "" {
+		n.Role = defaults.Role
+	}
+	if n.Reboot == nil {
+		n.Reboot = defaults.Reboot
+	}
+	if n.Poweroff == nil {
+		n.Poweroff = defaults.Poweroff
+	}
+	if n.Template == nil {
+		n.Template = defaults.Template
+	}
+	n.Labels = mergeMaps(defaults.Labels, n.Labels)
+	n.Values = mergeMaps(defaults.Values, n.Values)
+	return n
+}
+
+func mergeMaps(maps ...map[string]string) map[string]string {
+	res := map[string]string{}
+	for _, m := range maps {
+		for k, v := range m {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+func (n inventoryNode) name() string {
+	switch {
+	case n.Name != "":
+		return n.Name
+	case n.Hostname != "":
+		return n.Hostname
+	default:
+		return strings.TrimSuffix(filepath.Base(n.Image), filepath.Ext(n.Image))
+	}
+}
+
+// applyOverrides sets the hostname, static role and labels of the node in the config.
+func applyOverrides(cc string, n inventoryNode) (string, error) {
+	if n.Hostname == "" && n.Role == "" && len(n.Labels) == 0 {
+		return cc, nil
+	}
+	c := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(cc), &c); err != nil {
+		return "", err
+	}
+	if c == nil {
+		c = map[string]interface{}{}
+	}
+	section := func(m map[string]interface{}, key string) map[string]interface{} {
+		s, ok := m[key].(map[string]interface{})
+		if !ok {
+			s = map[string]interface{}{}
+			m[key] = s
+		}
+		return s
+	}
+
+	if n.Hostname != "" {
+		stages := section(c, "stages")
+		list, _ := stages["initramfs"].([]interface{})
+		stages["initramfs"] = append(list, map[string]interface{}{
+			"name":     "Set the inventory hostname",
+			"hostname": n.Hostname,
+		})
+	}
+	if n.Role != "" {
+		section(c, "p2p")["role"] = n.Role
+	}
+
+	if len(n.Labels) > 0 {
+		keys := []string{}
+		for k := range n.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		labels := []string{}
+		for _, k := range keys {
+			labels = append(labels, fmt.Sprintf("%s=%s", k, n.Labels[k]))
+		}
+
+		// Clusters formed over P2P use k3s, unless a distribution is configured
+		distributions := []string{}
+		for _, d := range []string{"k3s", "k3s-agent", "k0s", "k0s-worker"} {
+			if _, ok := c[d]; ok {
+				distributions = append(distributions, d)
+			}
+		}
+		if len(distributions) == 0 {
+			distributions = []string{"k3s", "k3s-agent"}
+		}
+		for _, d := range distributions {
+			s := section(c, d)
+			args, _ := s["args"].([]interface{})
+			if strings.HasPrefix(d, "k0s") {
+				args = append(args, "--labels="+strings.Join(labels, ","))
+			} else {
+				for _, l := range labels {
+					args = append(args, "--node-label="+l)
+				}
+			}
+			s["args"] = args
+		}
+	}
+
+	y, err := yaml.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("#cloud-config\n\n%s", string(y)), nil
+}
+
+// inventoryRegistration registers the nodes of an inventory.
+type inventoryRegistration struct {
+	inventory *inventory
+	opts      pairingOptions
+	out       io.Writer
+
+	sync.Mutex
+	results []registrationResult
+}
+
+func (r *inventoryRegistration) printf(name string) func(string, ...interface{}) {
+	return func(format string, a ...interface{}) {
+		r.Lock()
+		defer r.Unlock()
+		fmt.Fprintf(r.out, "[%s] %s\n", name, fmt.Sprintf(format, a...))
+	}
+}
+
+// registration reads the QR code and the config template of the node.
+func (r *inventoryRegistration) registration(n inventoryNode) (string, registration, error) {
+	reg := registration{}
+	token, err := qr.Scan(n.Image)
+	if err != nil {
+		return "", reg, fmt.Errorf("could not read the QR code: %w", err)
+	}
+	if token == "" {
+		return "", reg, errors.New("no QR code found in the image")
+	}
+	if n.Config == "" {
+		return "", reg, errors.New("no config given")
+	}
+	dat, err := os.ReadFile(n.Config)
+	if err != nil {
+		return "", reg, err
+	}
+
+	return token, registration{
+		Name:   n.Config,
+		Config: string(dat),
+		Data: templateData{
+			Values: n.Values,
+			Node: templateNode{
+				Name:     n.name(),
+				Image:    n.Image,
+				Device:   n.Device,
+				Hostname: n.Hostname,
+				Role:     n.Role,
+				Labels:   n.Labels,
+			},
+		},
+		Template:  n.Template != nil && *n.Template,
+		Overrides: n,
+		Device:    n.Device,
+		Reboot:    n.Reboot != nil && *n.Reboot,
+		Poweroff:  n.Poweroff != nil && *n.Poweroff,
+	}, nil
+}
+
+func (r *inventoryRegistration) addResult(res registrationResult) {
+	r.Lock()
+	r.results = append(r.results, res)
+	r.Unlock()
+}
+
+func (r *inventoryRegistration) register(ctx context.Context, n inventoryNode) {
+	n = n.merge(r.inventory.Defaults)
+	start := time.Now()
+	printf := r.printf(n.name())
+
+	ctx, cancel := context.WithTimeout(ctx, r.opts.Timeout)
+	defer cancel()
+
+	token, reg, err := r.registration(n)
+	if err == nil {
+		printf("Sending registration payload")
+		err = sendRegistration(ctx, token, reg, r.opts, printf)
+	}
+
+	res := registrationResult{Name: n.name(), Image: n.Image, Duration: time.Since(start).Round(time.Second)}
+	if err != nil {
+		res.Error = err.Error()
+		printf("Registration failed: %s", err.Error())
+	}
+	r.addResult(res)
+}
+
+// run registers the nodes, concurrently, returning once they are all done.
+// Once ctx is done, the registrations in progress are cancelled, the queued
+// nodes are not registered and no new images are looked for.
+func (r *inventoryRegistration) run(ctx context.Context) {
+	concurrency := r.inventory.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	sem := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+	start := func(n inventoryNode) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				n = n.merge(r.inventory.Defaults)
+				r.addResult(registrationResult{Name: n.name(), Image: n.Image, Error: "interrupted before the registration started"})
+				return
+			}
+			r.register(ctx, n)
+		}()
+	}
+
+	if r.inventory.Watch == "" {
+		for _, n := range r.inventory.Nodes {
+			start(n)
+		}
+	} else {
+		r.watch(ctx, start)
+	}
+	wg.Wait()
+}
+
+// watch starts the registration of the images added to the watched directory,
+// once their size settles.
+func (r *inventoryRegistration) watch(ctx context.Context, start func(inventoryNode)) {
+	nodes := map[string]inventoryNode{}
+	for _, n := range r.inventory.Nodes {
+		nodes[filepath.Base(n.Image)] = n
+	}
+	sizes := map[string]int64{}
+	started := map[string]bool{}
+
+	r.printf("watch")("Waiting for QR images in %s, interrupt to stop", r.inventory.Watch)
+	for {
+		entries, err := os.ReadDir(r.inventory.Watch)
+		if err != nil {
+			r.printf("watch")("%s", err.Error())
+		}
+		for _, e := range entries {
+			if e.IsDir() || started[e.Name()] || !isImage(e.Name()) {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			if size, ok := sizes[e.Name()]; !ok || size != info.Size() {
+				sizes[e.Name()] = info.Size()
+				continue
+			}
+
+			started[e.Name()] = true
+			n := nodes[e.Name()]
+			n.Image = filepath.Join(r.inventory.Watch, e.Name())
+			start(n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchInterval):
+		}
+	}
+}
+
+func isImage(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range imageExtensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+func printRegistrationSummary(w io.Writer, results []registrationResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tIMAGE\tRESULT\tDURATION\tERROR")
+	for _, r := range results {
+		result := "registered"
+		if r.Error != "" {
+			result = "failed"
+		}
+		// Only the first line of multiline errors fits the table
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Name, r.Image, result, r.Duration, strings.SplitN(r.Error, "\n", 2)[0])
+	}
+	tw.Flush()
+}
+
+// registerInventory registers the nodes of the inventory and prints a summary.
+// The --set values are the defaults of the inventory values.
+func registerInventory(path string, defaults inventoryNode, values map[string]string, concurrency int, opts pairingOptions) error {
+	inv, err := readInventory(path)
+	if err != nil {
+		return err
+	}
+	defaults.Values = values
+	inv.Defaults = inv.Defaults.merge(defaults)
+	if concurrency > 0 {
+		inv.Concurrency = concurrency
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	r := &inventoryRegistration{inventory: inv, opts: opts, out: os.Stdout}
+	r.run(ctx)
+
+	sort.Slice(r.results, func(i, j int) bool { return r.results[i].Name < r.results[j].Name })
+	fmt.Println()
+	printRegistrationSummary(os.Stdout, r.results)
+
+	failed := 0
+	for _, res := range r.results {
+		if res.Error != "" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d registrations failed", failed, len(r.results))
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gopkg.in/yaml.v3"
+)
+
+var _ = Describe("Inventory", func() {
+	write := func(content string) string {
+		path := filepath.Join(GinkgoT().TempDir(), "nodes.yaml")
+		Expect(os.WriteFile(path, []byte(content), 0600)).To(Succeed())
+		return path
+	}
+
+	Context("readInventory", func() {
+		It("resolves the paths relative to the inventory", func() {
+			path := write(`
+defaults:
+  config: config.yaml
+nodes:
+- image: qr/node1.png
+  config: /etc/master.yaml
+`)
+			inv, err := readInventory(path)
+			Expect(err).ToNot(HaveOccurred())
+			dir := filepath.Dir(path)
+			Expect(inv.Defaults.Config).To(Equal(filepath.Join(dir, "config.yaml")))
+			Expect(inv.Nodes[0].Image).To(Equal(filepath.Join(dir, "qr/node1.png")))
+			Expect(inv.Nodes[0].Config).To(Equal("/etc/master.yaml"))
+		})
+
+		It("keeps the image names of a watched directory", func() {
+			inv, err := readInventory(write("watch: qr\nnodes:\n- image: node1.png\n"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(inv.Watch).To(HaveSuffix("/qr"))
+			Expect(inv.Nodes[0].Image).To(Equal("node1.png"))
+		})
+
+		It("requires nodes with images", func() {
+			_, err := readInventory(write("defaults:\n  device: /dev/sda\n"))
+			Expect(err).To(MatchError("the inventory lists no nodes nor a directory to watch"))
+			_, err = readInventory(write("nodes:\n- hostname: node1\n"))
+			Expect(err).To(MatchError("no image given for the node 'node1'"))
+		})
+	})
+
+	It("merges the node with the defaults", func() {
+		reboot, poweroff := true, false
+		n := inventoryNode{Image: "qr/node1.png", Device: "/dev/nvme0n1", Poweroff: &poweroff, Labels: map[string]string{"zone": "b"}, Values: map[string]string{"ip": "10.0.0.2"}}.
+			merge(inventoryNode{Config: "config.yaml", Device: "/dev/sda", Reboot: &reboot, Labels: map[string]string{"site": "x", "zone": "a"}, Values: map[string]string{"ip": "10.0.0.1", "gw": "10.0.0.254"}})
+		Expect(n.Config).To(Equal("config.yaml"))
+		Expect(n.Device).To(Equal("/dev/nvme0n1"))
+		Expect(*n.Reboot).To(BeTrue())
+		Expect(*n.Poweroff).To(BeFalse())
+		Expect(n.Labels).To(Equal(map[string]string{"site": "x", "zone": "b"}))
+		Expect(n.Values).To(Equal(map[string]string{"ip": "10.0.0.2", "gw": "10.0.0.254"}))
+		Expect(n.name()).To(Equal("node1"))
+	})
+
+	Context("applyOverrides", func() {
+		It("leaves the config untouched without overrides", func() {
+			Expect(applyOverrides("#cloud-config\n# comment\n", inventoryNode{})).To(Equal("#cloud-config\n# comment\n"))
+		})
+
+		It("sets the hostname, role and labels", func() {
+			cc, err := applyOverrides("#cloud-config\np2p:\n  network_token: foo\n", inventoryNode{
+				Hostname: "node1",
+				Role:     "master",
+				Labels:   map[string]string{"zone": "a", "site": "x"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			c := map[string]interface{}{}
+			Expect(yaml.Unmarshal([]byte(cc), &c)).To(Succeed())
+			Expect(c["p2p"]).To(Equal(map[string]interface{}{"network_token": "foo", "role": "master"}))
+			Expect(c["stages"]).To(Equal(map[string]interface{}{"initramfs": []interface{}{
+				map[string]interface{}{"name": "Set the inventory hostname", "hostname": "node1"},
+			}}))
+			args := []interface{}{"--node-label=site=x", "--node-label=zone=a"}
+			Expect(c["k3s"]).To(Equal(map[string]interface{}{"args": args}))
+			Expect(c["k3s-agent"]).To(Equal(map[string]interface{}{"args": args}))
+		})
+
+		It("adds the labels to the configured distribution", func() {
+			cc, err := applyOverrides("k0s-worker:\n  enabled: true\n  args: [--debug]\n", inventoryNode{Labels: map[string]string{"zone": "a", "site": "x"}})
+			Expect(err).ToNot(HaveOccurred())
+			c := map[string]interface{}{}
+			Expect(yaml.Unmarshal([]byte(cc), &c)).To(Succeed())
+			Expect(c).To(HaveLen(1))
+			Expect(c["k0s-worker"]).To(Equal(map[string]interface{}{
+				"enabled": true,
+				"args":    []interface{}{"--debug", "--labels=site=x,zone=a"},
+			}))
+		})
+	})
+
+	It("prints the summary", func() {
+		buf := &bytes.Buffer{}
+		printRegistrationSummary(buf, []registrationResult{
+			{Name: "node1", Image: "qr/node1.png", Duration: 42 * time.Second},
+			{Name: "node2", Image: "qr/node2.png", Duration: time.Second, Error: "the node rejected the configuration:\n  - bad"},
+		})
+		Expect(buf.String()).To(Equal(`NODE   IMAGE         RESULT      DURATION  ERROR
+node1  qr/node1.png  registered  42s       
+node2  qr/node2.png  failed      1s        the node rejected the configuration:
+`))
+	})
+
+	It("doesn't start registrations once interrupted", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		r := &inventoryRegistration{inventory: &inventory{Nodes: []inventoryNode{{Image: "qr/node1.png"}, {Image: "qr/node2.png"}}}, out: io.Discard}
+		r.run(ctx)
+		Expect(r.results).To(HaveLen(2))
+		for _, res := range r.results {
+			Expect(res.Error).To(Equal("interrupted before the registration started"))
+		}
+	})
+
+	It("recognizes images", func() {
+		Expect(isImage("node1.PNG")).To(BeTrue())
+		Expect(isImage("nodes.yaml")).To(BeFalse())
+	})
+})
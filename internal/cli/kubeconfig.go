@@ -0,0 +1,181 @@
+package cli
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// kubeconfig is kept as a generic map, so that fields not handled here are preserved.
+type kubeconfig map[string]interface{}
+
+func parseKubeconfig(data []byte) (kubeconfig, error) {
+	// Decoding into the named type would make nested maps kubeconfig too
+	k := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &k); err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig: %w", err)
+	}
+	return kubeconfig(k), nil
+}
+
+// entries returns the named entries of a kubeconfig section (clusters, contexts or users).
+func (k kubeconfig) entries(section string) []map[string]interface{} {
+	list, _ := k[section].([]interface{})
+	res := []map[string]interface{}{}
+	for _, e := range list {
+		if m, ok := e.(map[string]interface{}); ok {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+func (k kubeconfig) setEntries(section string, entries []map[string]interface{}) {
+	list := []interface{}{}
+	for _, e := range entries {
+		list = append(list, e)
+	}
+	k[section] = list
+}
+
+// renamed returns the new name of an entry, after the network ID.
+func renamed(networkID, name string, total int) string {
+	if total == 1 {
+		return networkID
+	}
+	return fmt.Sprintf("%s-%s", networkID, name)
+}
+
+// serverURL replaces the host of an API server URL, keeping scheme and port.
+func serverURL(server, host string) (string, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", fmt.Errorf("invalid server '%s': %w", server, err)
+	}
+	if port := u.Port(); port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else {
+		u.Host = host
+	}
+	return u.String(), nil
+}
+
+// rewrite points the kubeconfig to the given host and renames clusters, contexts
+// and users after the network ID.
+func (k kubeconfig) rewrite(networkID, host string) error {
+	names := map[string]map[string]string{}
+	for _, section := range []string{"clusters", "contexts", "users"} {
+		names[section] = map[string]string{}
+		entries := k.entries(section)
+		for _, e := range entries {
+			name, _ := e["name"].(string)
+			names[section][name] = renamed(networkID, name, len(entries))
+			e["name"] = names[section][name]
+		}
+		k.setEntries(section, entries)
+	}
+
+	for _, e := range k.entries("clusters") {
+		cluster, _ := e["cluster"].(map[string]interface{})
+		if server, ok := cluster["server"].(string); ok {
+			u, err := serverURL(server, host)
+			if err != nil {
+				return err
+			}
+			cluster["server"] = u
+		}
+	}
+
+	for _, e := range k.entries("contexts") {
+		context, _ := e["context"].(map[string]interface{})
+		if c, ok := context["cluster"].(string); ok {
+			context["cluster"] = names["clusters"][c]
+		}
+		if u, ok := context["user"].(string); ok {
+			context["user"] = names["users"][u]
+		}
+	}
+
+	if current, ok := k["current-context"].(string); ok && current != "" {
+		k["current-context"] = names["contexts"][current]
+	}
+	return nil
+}
+
+// merge adds the entries of other, replacing the ones with the same name.
+// The current context is set only if there is none.
+func (k kubeconfig) merge(other kubeconfig) {
+	if k["apiVersion"] == nil {
+		k["apiVersion"] = "v1"
+	}
+	if k["kind"] == nil {
+		k["kind"] = "Config"
+	}
+
+	for _, section := range []string{"clusters", "contexts", "users"} {
+		added := other.entries(section)
+		replaced := map[interface{}]bool{}
+		for _, e := range added {
+			replaced[e["name"]] = true
+		}
+		res := []map[string]interface{}{}
+		for _, e := range k.entries(section) {
+			if !replaced[e["name"]] {
+				res = append(res, e)
+			}
+		}
+		k.setEntries(section, append(res, added...))
+	}
+
+	if current, _ := k["current-context"].(string); current == "" {
+		k["current-context"] = other["current-context"]
+	}
+}
+
+// defaultKubeconfigPath returns the first path in $KUBECONFIG, or ~/.kube/config.
+func defaultKubeconfigPath() (string, error) {
+	if env := os.Getenv("KUBECONFIG"); env != "" {
+		return strings.Split(env, string(os.PathListSeparator))[0], nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".kube", "config"), nil
+}
+
+// writeKubeconfig writes the kubeconfig readable by the owner only.
+func writeKubeconfig(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	// WriteFile doesn't change the mode of existing files
+	return os.Chmod(path, 0600)
+}
+
+// mergeKubeconfigFile merges the kubeconfig into the one at path, creating it if needed.
+func mergeKubeconfigFile(path string, k kubeconfig) error {
+	existing := kubeconfig{}
+	if data, err := os.ReadFile(path); err == nil {
+		if existing, err = parseKubeconfig(data); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	existing.merge(k)
+	data, err := yaml.Marshal(existing)
+	if err != nil {
+		return err
+	}
+	return writeKubeconfig(path, data)
+}
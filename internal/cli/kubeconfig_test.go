@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gopkg.in/yaml.v3"
+)
+
+const k3sKubeconfig = `apiVersion: v1
+clusters:
+- cluster:
+    certificate-authority-data: Y2E=
+    server: https://127.0.0.1:6443
+  name: default
+contexts:
+- context:
+    cluster: default
+    user: default
+  name: default
+current-context: default
+kind: Config
+preferences: {}
+users:
+- name: default
+  user:
+    client-certificate-data: MTI3LjAuMC4x
+    client-key-data: a2V5
+`
+
+var _ = Describe("Kubeconfig", func() {
+	var k kubeconfig
+
+	BeforeEach(func() {
+		var err error
+		k, err = parseKubeconfig([]byte(k3sKubeconfig))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("points the server to the endpoint and renames entries after the network", func() {
+		Expect(k.rewrite("edge", "10.1.0.100")).To(Succeed())
+
+		out, err := yaml.Marshal(k)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(out)).To(MatchYAML(`apiVersion: v1
+clusters:
+- cluster:
+    certificate-authority-data: Y2E=
+    server: https://10.1.0.100:6443
+  name: edge
+contexts:
+- context:
+    cluster: edge
+    user: edge
+  name: edge
+current-context: edge
+kind: Config
+preferences: {}
+users:
+- name: edge
+  user:
+    client-certificate-data: MTI3LjAuMC4x
+    client-key-data: a2V5
+`))
+	})
+
+	It("supports IPv6 and DNS endpoints", func() {
+		Expect(serverURL("https://127.0.0.1:6443", "fd00::1")).To(Equal("https://[fd00::1]:6443"))
+		Expect(serverURL("https://127.0.0.1:6443", "api.edge")).To(Equal("https://api.edge:6443"))
+	})
+
+	It("merges into an existing kubeconfig file with owner only permissions", func() {
+		dir, err := os.MkdirTemp("", "kubeconfig")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, ".kube", "config")
+
+		other, err := parseKubeconfig([]byte(k3sKubeconfig))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(other.rewrite("other", "10.2.0.1")).To(Succeed())
+		Expect(mergeKubeconfigFile(path, other)).To(Succeed())
+
+		Expect(k.rewrite("edge", "10.1.0.100")).To(Succeed())
+		Expect(mergeKubeconfigFile(path, k)).To(Succeed())
+		// Merging again replaces the entries
+		Expect(mergeKubeconfigFile(path, k)).To(Succeed())
+
+		info, err := os.Stat(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+
+		data, err := os.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		merged, err := parseKubeconfig(data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(merged["current-context"]).To(Equal("other"))
+		for _, section := range []string{"clusters", "contexts", "users"} {
+			names := []interface{}{}
+			for _, e := range merged.entries(section) {
+				names = append(names, e["name"])
+			}
+			Expect(names).To(Equal([]interface{}{"other", "edge"}))
+		}
+	})
+})
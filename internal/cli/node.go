@@ -0,0 +1,110 @@
+package cli
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/kairos-io/provider-kairos/v2/internal/operator"
+	"github.com/kairos-io/provider-kairos/v2/internal/role"
+	edgeVPNClient "github.com/mudler/edgevpn/api/client"
+	"github.com/mudler/edgevpn/api/client/service"
+	"github.com/urfave/cli/v2"
+)
+
+var NodeCMD = cli.Command{
+	Name:  "node",
+	Usage: "Approve or deny nodes joining the network",
+	Description: `
+		Manages the admission of nodes when p2p.admission is enabled. Nodes publish
+		an identity key generated on first boot, and get a role only once approved.
+
+		Decisions are signed with an operator key, see operator-key generate. Nodes
+		only follow the decisions signed with a key listed in their config:
+
+		  p2p:
+		    admission:
+		      enable: true
+		      trusted_keys:
+		      - <public key>
+		`,
+	Subcommands: []*cli.Command{
+		{
+			Flags: append([]cli.Flag{
+				&cli.StringFlag{
+					Name:  "fingerprint",
+					Usage: "Approve only if the node key matches the fingerprint",
+				},
+				signKeyFlag,
+			}, networkAPI...),
+			Name:      "approve",
+			Usage:     "Approve a node",
+			UsageText: "kairos node approve --sign-key operator.key <UUID>",
+			Action: func(c *cli.Context) error {
+				uuid := c.Args().Get(0)
+				if uuid == "" {
+					return fmt.Errorf("a node UUID is required")
+				}
+				key, err := operator.ReadKey(c.String("sign-key"))
+				if err != nil {
+					return err
+				}
+				cc := service.NewClient(
+					c.String("network-id"),
+					edgeVPNClient.NewClient(edgeVPNClient.WithHost(c.String("api"))))
+
+				claim, _ := cc.Get(role.IdentityBucket, uuid)
+				fingerprint, err := role.VerifyIdentity(uuid, claim)
+				if err != nil {
+					return fmt.Errorf("node %s: %w", uuid, err)
+				}
+				if expected := c.String("fingerprint"); expected != "" && expected != fingerprint {
+					return fmt.Errorf("node %s has key %s, expected %s", uuid, fingerprint, expected)
+				}
+
+				if err := cc.Set(role.AdmissionBucket, uuid, role.Approval(key, uuid, fingerprint)); err != nil {
+					return err
+				}
+				fmt.Printf("Approved %s (%s)\n", uuid, fingerprint)
+				return nil
+			},
+		},
+		{
+			Flags:     append([]cli.Flag{signKeyFlag}, networkAPI...),
+			Name:      "deny",
+			Usage:     "Deny a node",
+			UsageText: "kairos node deny --sign-key operator.key <UUID>",
+			Action: func(c *cli.Context) error {
+				uuid := c.Args().Get(0)
+				if uuid == "" {
+					return fmt.Errorf("a node UUID is required")
+				}
+				key, err := operator.ReadKey(c.String("sign-key"))
+				if err != nil {
+					return err
+				}
+				cc := service.NewClient(
+					c.String("network-id"),
+					edgeVPNClient.NewClient(edgeVPNClient.WithHost(c.String("api"))))
+				return cc.Set(role.AdmissionBucket, uuid, role.Denial(key, uuid))
+			},
+		},
+		{
+			Flags:       networkAPI,
+			Name:        "list-pending",
+			Description: "List nodes waiting for approval",
+			Action: func(c *cli.Context) error {
+				cc := service.NewClient(
+					c.String("network-id"),
+					edgeVPNClient.NewClient(edgeVPNClient.WithHost(c.String("api"))))
+				advertizing, _ := cc.AdvertizingNodes()
+				pending := role.PendingNodes(cc, advertizing)
+				fmt.Println("Node\tFingerprint")
+				for _, n := range slices.Sorted(maps.Keys(pending)) {
+					fmt.Printf("%s\t%s\n", n, pending[n])
+				}
+				return nil
+			},
+		},
+	},
+}
@@ -0,0 +1,67 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/kairos-io/provider-kairos/v2/internal/operator"
+	"github.com/urfave/cli/v2"
+)
+
+var signKeyFlag = &cli.StringFlag{
+	Name:     "sign-key",
+	Usage:    "Operator key to sign with, see operator-key generate",
+	Required: true,
+}
+
+var OperatorKeyCMD = cli.Command{
+	Name:  "operator-key",
+	Usage: "Manage the operator keys signing the node admissions, the token rotations and the pairing payloads",
+	Subcommands: []*cli.Command{
+		{
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "output",
+					Aliases: []string{"o"},
+					Value:   "operator.key",
+					Usage:   "Where to write the private key",
+				},
+			},
+			Name:      "generate",
+			Usage:     "Generate an operator key",
+			UsageText: "kairos operator-key generate [--output operator.key]",
+			Description: `
+		Writes a new ed25519 private key, used with the --sign-key flag of
+		node approve, token rotate and register, and prints its public key.
+		Nodes trust it once listed in their config:
+
+		  p2p:
+		    admission:
+		      trusted_keys:
+		      - <public key>
+		    token_rotation:
+		      trusted_keys:
+		      - <public key>
+		  # In the image config, for the pairing payloads
+		  pairing:
+		    trusted_keys:
+		    - <public key>
+		`,
+			Action: func(c *cli.Context) error {
+				path := c.String("output")
+				if _, err := os.Stat(path); err == nil {
+					return fmt.Errorf("%s already exists", path)
+				}
+				priv, pub, err := operator.GenerateKey()
+				if err != nil {
+					return err
+				}
+				if err := os.WriteFile(path, priv, 0600); err != nil {
+					return err
+				}
+				fmt.Println(pub)
+				return nil
+			},
+		},
+	},
+}
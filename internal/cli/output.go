@@ -0,0 +1,39 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+var outputFlag = &cli.StringFlag{
+	Name:    "output",
+	Aliases: []string{"o"},
+	Usage:   "Output format: table, json or yaml",
+	Value:   "table",
+}
+
+// printOutput prints v as JSON or YAML, or as a table using the given function.
+func printOutput(w io.Writer, format string, v interface{}, table func(io.Writer)) error {
+	switch format {
+	case "", "table":
+		table(w)
+		return nil
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "yaml":
+		dat, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(dat)
+		return err
+	default:
+		return fmt.Errorf("unknown output format '%s'", format)
+	}
+}
@@ -0,0 +1,63 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Output", func() {
+	roles := []nodeRole{{UUID: "a", Role: "master"}}
+
+	It("prints JSON, YAML or a table", func() {
+		buf := &bytes.Buffer{}
+		Expect(printOutput(buf, "json", roles, nil)).To(Succeed())
+		Expect(buf.String()).To(MatchJSON(`[{"uuid": "a", "role": "master"}]`))
+
+		buf.Reset()
+		Expect(printOutput(buf, "yaml", roles, nil)).To(Succeed())
+		Expect(buf.String()).To(MatchYAML("- uuid: a\n  role: master\n"))
+
+		buf.Reset()
+		Expect(printOutput(buf, "table", roles, func(w io.Writer) { w.Write([]byte("table")) })).To(Succeed()) //nolint:errcheck
+		Expect(buf.String()).To(Equal("table"))
+
+		Expect(printOutput(buf, "xml", roles, nil)).ToNot(Succeed())
+	})
+
+	It("converts the kubeconfig to JSON", func() {
+		out, err := kubeconfigOutput(kubeconfig{"apiVersion": "v1", "kind": "Config"}, "json")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(MatchJSON(`{"apiVersion": "v1", "kind": "Config"}`))
+
+		_, err = kubeconfigOutput(kubeconfig{"kind": "Config"}, "toml")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("waits until data is published", func() {
+		defer func(i time.Duration) { waitInterval = i }(waitInterval)
+		waitInterval = time.Millisecond
+
+		calls := 0
+		Expect(waitFor(context.Background(), time.Minute, func() error {
+			calls++
+			if calls < 3 {
+				return errors.New("not yet")
+			}
+			return nil
+		})).To(Succeed())
+		Expect(calls).To(Equal(3))
+
+		calls = 0
+		Expect(waitFor(context.Background(), 0, func() error {
+			calls++
+			return errors.New("not yet")
+		})).To(MatchError("not yet"))
+		Expect(calls).To(Equal(1))
+	})
+})
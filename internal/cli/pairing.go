@@ -0,0 +1,32 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"syscall"
+
+	"github.com/kairos-io/provider-kairos/v2/internal/pairing"
+	cliV2 "github.com/urfave/cli/v2"
+)
+
+// processRunning tells if the process with the given PID is still alive.
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
+
+// StartPairingRelay reports the result and the install progress of the node to the registering operator.
+func StartPairingRelay(c *cliV2.Context) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := pairing.Open(ctx, c.String("token"), "")
+	if err != nil {
+		return err
+	}
+	pid := c.Int("agent-pid")
+	return ch.Relay(ctx, c.String("state-dir"), func() bool { return processRunning(pid) })
+}
@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	qrcode "github.com/skip2/go-qrcode"
+	"github.com/urfave/cli/v2"
+)
+
+// qrSize is the size in pixels of the PNG files.
+const qrSize = 512
+
+// qrOutputFlags choose where and how a QR code is rendered, shared by all the commands printing one.
+var qrOutputFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "qr-output",
+		Usage: "Write a QR code to the given PNG file",
+	},
+	&cli.BoolFlag{
+		Name:  "qr-invert",
+		Usage: "Invert the colors of the terminal QR code, for light backgrounds",
+	},
+}
+
+var qrFlags = append([]cli.Flag{
+	&cli.BoolFlag{
+		Name:  "qr",
+		Usage: "Print a QR code on the terminal",
+	},
+}, qrOutputFlags...)
+
+// newQR uses the low recovery level, which leaves room for a full config.
+// The codes are scanned from a screen or a print anyway.
+func newQR(content string) (*qrcode.QRCode, error) {
+	q, err := qrcode.New(content, qrcode.Low)
+	if err != nil {
+		return nil, fmt.Errorf("could not create QR code (%d bytes): %w", len(content), err)
+	}
+	return q, nil
+}
+
+// writeQR writes content as a PNG file if path is set, or on the terminal.
+func writeQR(w io.Writer, content, path string, invert bool) error {
+	q, err := newQR(content)
+	if err != nil {
+		return err
+	}
+	if path != "" {
+		// The QR code holds the token, keep it as private as the token itself
+		png, err := q.PNG(qrSize)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, png, 0600)
+	}
+	_, err = fmt.Fprint(w, q.ToSmallString(invert))
+	return err
+}
+
+// printWithQR prints content, or renders it as a QR code as requested by qrFlags.
+// The content is still printed when the QR code goes to a file.
+func printWithQR(c *cli.Context, content string) error {
+	if c.String("qr-output") != "" {
+		if err := writeQR(os.Stdout, content, c.String("qr-output"), false); err != nil {
+			return err
+		}
+	}
+	if c.Bool("qr") {
+		return writeQR(os.Stdout, content, "", c.Bool("qr-invert"))
+	}
+	_, err := fmt.Print(content)
+	return err
+}
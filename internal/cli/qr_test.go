@@ -0,0 +1,33 @@
+package cli
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("QR codes", func() {
+	It("renders on the terminal or to a PNG file", func() {
+		buf := &bytes.Buffer{}
+		Expect(writeQR(buf, "#cloud-config\n", "", false)).To(Succeed())
+		Expect(buf.String()).To(ContainSubstring("█"))
+
+		path := filepath.Join(GinkgoT().TempDir(), "config.png")
+		Expect(writeQR(buf, "#cloud-config\n", path, false)).To(Succeed())
+		dat, err := os.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dat[:8]).To(Equal([]byte("\x89PNG\r\n\x1a\n")))
+
+		info, err := os.Stat(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+	})
+
+	It("fails on content too long for a QR code", func() {
+		Expect(writeQR(&bytes.Buffer{}, strings.Repeat("a", 5000), "", false)).To(MatchError(ContainSubstring("5000 bytes")))
+	})
+})
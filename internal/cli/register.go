@@ -2,13 +2,17 @@ package cli
 
 import (
 	"context"
+	"crypto/ed25519"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/urfave/cli/v2"
 
-	nodepair "github.com/kairos-io/go-nodepair"
 	qr "github.com/kairos-io/go-nodepair/qrcode"
+	"github.com/kairos-io/provider-kairos/v2/internal/operator"
+	"github.com/kairos-io/provider-kairos/v2/internal/pairing"
 )
 
 // RegisterCMD is only used temporarily to avoid duplication while the kairosctl sub-command is deprecated.
@@ -24,8 +28,49 @@ func RegisterCMD(toolName string) *cli.Command {
 
 		will decode the QR code from ~/Downloads/screenshot.png and bootstrap the node remotely.
 
+		With --wait, the command shows whether the node accepted the configuration and
+		follows the installation until the node reboots, failing with the node errors.
+
 		If the image is omitted, a screenshot will be taken and used to decode the QR code.
 
+		With --inventory, the nodes listed in the inventory file are registered concurrently,
+		with a summary at the end. --config, --device, --reboot and --poweroff are the defaults
+		of the inventory:
+
+		  concurrency: 4
+		  defaults:
+		    config: config.yaml
+		    device: /dev/sda
+		    reboot: true
+		    template: true
+		  # Register the images added to the directory, until interrupted
+		  # watch: ./qr
+		  nodes:
+		  - image: qr/node1.png
+		    hostname: node1
+		    role: master
+		    labels:
+		      zone: a
+		  - image: qr/node2.png
+		    device: /dev/nvme0n1
+		    values:
+		      ip: 192.168.1.12
+
+		With --template, or template: true in the inventory, the config is a Go template, with
+		the sprig functions. Escape the expressions rendered on the node, e.g. {{"{{"}} .Random }}.
+		It is rendered with:
+		  .Values  the --set key=value pairs, and the inventory values
+		  .Node    the inventory entry: .Name, .Image, .Device, .Hostname, .Role and .Labels
+		  .Facts   the facts the node reports during pairing: .UUID, .Serial, .MAC and .MACs.
+		           The payload is then only sent to the node which reported them.
+		The rendered config is validated before it is sent.
+
+		Nodes with pairing.trusted_keys in their image config only install payloads signed
+		with one of these keys, given with --sign-key. They bind a one-time key to their QR
+		code, and the payload is signed for it, so that it can't be replayed to another node.
+		With --encrypt, the payload is also encrypted to it, so that it can only be read by
+		the node showing the QR code.
+
 		See also https://kairos.io/docs/getting-started/ for documentation.
 		`, fullName)
 	if toolName != "kairosctl" {
@@ -41,9 +86,24 @@ func RegisterCMD(toolName string) *cli.Command {
 		ArgsUsage:   "Register optionally accepts an image. If nothing is passed will take a screenshot of the screen and try to decode the QR code",
 		Flags: []cli.Flag{
 			&cli.StringFlag{
-				Name:     "config",
-				Usage:    "Kairos YAML configuration file",
-				Required: true,
+				Name:  "config",
+				Usage: "Kairos YAML configuration file",
+			},
+			&cli.StringFlag{
+				Name:  "inventory",
+				Usage: "Register the nodes listed in the given inventory file",
+			},
+			&cli.BoolFlag{
+				Name:  "template",
+				Usage: "Render the config as a template before sending it",
+			},
+			&cli.StringSliceFlag{
+				Name:  "set",
+				Usage: "Set a value of the config template, as key=value",
+			},
+			&cli.IntFlag{
+				Name:  "concurrency",
+				Usage: "Nodes registered at the same time with --inventory (default: the inventory concurrency, or 4)",
 			},
 			&cli.StringFlag{
 				Name:  "device",
@@ -61,14 +121,60 @@ func RegisterCMD(toolName string) *cli.Command {
 				Name:  "log-level",
 				Usage: "Set log level",
 			},
+			&cli.BoolFlag{
+				Name:  "wait",
+				Usage: "Wait for the node to validate the configuration and follow the installation",
+			},
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "How long to wait for the installation with --wait, or for each node with --inventory",
+				Value: time.Hour,
+			},
+			&cli.StringFlag{
+				Name:  "sign-key",
+				Usage: "Sign the payload with the given operator key, see operator-key generate",
+			},
+			&cli.BoolFlag{
+				Name:  "encrypt",
+				Usage: "Encrypt the payload to the one-time key of the node",
+			},
 		},
 		Action: func(c *cli.Context) error {
+			values, err := parseSet(c.StringSlice("set"))
+			if err != nil {
+				return err
+			}
+			opts, err := pairingOptionsFromFlags(c)
+			if err != nil {
+				return err
+			}
+
+			if c.String("inventory") != "" {
+				defaults := inventoryNode{Config: c.String("config"), Device: c.String("device")}
+				if c.IsSet("reboot") {
+					reboot := c.Bool("reboot")
+					defaults.Reboot = &reboot
+				}
+				if c.IsSet("poweroff") {
+					poweroff := c.Bool("poweroff")
+					defaults.Poweroff = &poweroff
+				}
+				if c.IsSet("template") {
+					template := c.Bool("template")
+					defaults.Template = &template
+				}
+				return registerInventory(c.String("inventory"), defaults, values, c.Int("concurrency"), opts)
+			}
+			if c.String("config") == "" {
+				return fmt.Errorf("--config or --inventory is required")
+			}
+
 			var ref string
 			if c.Args().Len() == 1 {
 				ref = c.Args().First()
 			}
 
-			return register(c.String("log-level"), ref, c.String("config"), c.String("device"), c.Bool("reboot"), c.Bool("poweroff"))
+			return register(ref, c.String("config"), c.String("device"), c.Bool("reboot"), c.Bool("poweroff"), c.Bool("template"), values, opts)
 		},
 	}
 }
@@ -95,7 +201,33 @@ func isReadable(fileName string) bool {
 	return true
 }
 
-func register(loglevel, arg, configFile, device string, reboot, poweroff bool) error {
+// pairingOptions are the settings shared by the registrations.
+type pairingOptions struct {
+	LogLevel string
+	Wait     bool
+	Timeout  time.Duration
+	SignKey  ed25519.PrivateKey
+	Encrypt  bool
+}
+
+func pairingOptionsFromFlags(c *cli.Context) (pairingOptions, error) {
+	opts := pairingOptions{
+		LogLevel: c.String("log-level"),
+		Wait:     c.Bool("wait"),
+		Timeout:  c.Duration("timeout"),
+		Encrypt:  c.Bool("encrypt"),
+	}
+	if c.String("sign-key") != "" {
+		key, err := operator.ReadKey(c.String("sign-key"))
+		if err != nil {
+			return opts, err
+		}
+		opts.SignKey = key
+	}
+	return opts, nil
+}
+
+func register(arg, configFile, device string, reboot, poweroff, template bool, values map[string]string, opts pairingOptions) error {
 	b, _ := os.ReadFile(configFile)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -114,9 +246,26 @@ func register(loglevel, arg, configFile, device string, reboot, poweroff bool) e
 	// dmesg -D to suppress tty ev
 	fmt.Println("Sending registration payload, please wait")
 
+	reg := registration{
+		Name:     configFile,
+		Config:   string(b),
+		Template: template,
+		Data:     templateData{Values: values},
+		Device:   device,
+		Reboot:   reboot,
+		Poweroff: poweroff,
+	}
+	return sendRegistration(ctx, qr.Reader(arg), reg, opts, printLine)
+}
+
+func printLine(format string, a ...interface{}) {
+	fmt.Printf(format+"\n", a...)
+}
+
+func pairingPayload(cc, device string, reboot, poweroff bool) map[string]string {
 	config := map[string]string{
 		"device": device,
-		"cc":     string(b),
+		"cc":     cc,
 	}
 
 	if reboot {
@@ -126,18 +275,84 @@ func register(loglevel, arg, configFile, device string, reboot, poweroff bool) e
 	if poweroff {
 		config["poweroff"] = ""
 	}
+	return config
+}
 
-	err := nodepair.Send(
-		ctx,
-		config,
-		nodepair.WithReader(qr.Reader),
-		nodepair.WithToken(arg),
-		nodepair.WithLogLevel(loglevel),
-	)
+// sendRegistration sends the payload to the node of the pairing token, printing the progress with printf.
+// The payload is validated before sending, and rendered with the node facts if the config uses them.
+func sendRegistration(ctx context.Context, token string, reg registration, opts pairingOptions, printf func(string, ...interface{})) error {
+	var payload map[string]string
+	var err error
+	if !reg.Template || !needsFacts(reg.Config) {
+		if payload, err = reg.payload(pairing.Facts{}); err != nil {
+			return err
+		}
+	}
+
+	ch, err := pairing.Open(ctx, token, opts.LogLevel)
 	if err != nil {
 		return err
 	}
+	factsPeer := ""
+	if payload == nil {
+		printf("Waiting for the node facts")
+		var facts pairing.Facts
+		factsPeer, facts, err = ch.Facts(ctx)
+		if err != nil {
+			return fmt.Errorf("the node didn't report its facts, it might run an older version: %w", err)
+		}
+		if payload, err = reg.payload(facts); err != nil {
+			return err
+		}
+	}
+	if opts.SignKey != nil || opts.Encrypt {
+		var nodeKey *[32]byte
+		if opts.Encrypt {
+			printf("Waiting for the node key")
+			if nodeKey, err = ch.NodeKey(ctx); err != nil {
+				return err
+			}
+		}
+		if payload, err = pairing.SealPayload(payload, ch.KeyHash(), opts.SignKey, nodeKey); err != nil {
+			return err
+		}
+	}
 
-	fmt.Println("Payload sent, installation will start on the machine briefly")
+	// Any peer sharing the token can report facts, the payload rendered with them only goes to that peer
+	if err := ch.Send(ctx, payload, factsPeer); err != nil {
+		return err
+	}
+
+	if !opts.Wait {
+		printf("Payload sent, installation will start on the machine briefly")
+		return nil
+	}
+	return waitInstall(ctx, ch, opts.Timeout, printf)
+}
+
+// waitInstall prints the reply of the node and the install progress.
+func waitInstall(ctx context.Context, ch *pairing.Channel, timeout time.Duration, printf func(string, ...interface{})) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	printf("Payload sent, waiting for the node to validate the configuration")
+	r, err := ch.Result(ctx)
+	if err != nil {
+		return fmt.Errorf("no reply from the node, it might run an older version: %w", err)
+	}
+	if !r.Accepted {
+		return fmt.Errorf("the node rejected the configuration:\n  - %s", strings.Join(r.Errors, "\n  - "))
+	}
+	printf("Configuration accepted, installing")
+
+	err = ch.Watch(ctx, func(p pairing.Progress) {
+		if p.Error == "" {
+			printf("[%s] %s", p.Time.Local().Format(time.TimeOnly), p.Stage)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	printf("Installation completed")
 	return nil
 }
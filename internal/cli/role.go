@@ -1,7 +1,10 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
 
 	edgeVPNClient "github.com/mudler/edgevpn/api/client"
 	"github.com/mudler/edgevpn/api/client/service"
@@ -35,21 +38,53 @@ var RoleCMD = cli.Command{
 			},
 		},
 		{
-			Flags:       networkAPI,
+			Flags:       append([]cli.Flag{outputFlag, waitFlag}, networkAPI...),
 			Name:        "list",
 			Description: "List node roles",
 			Action: func(c *cli.Context) error {
 				cc := service.NewClient(
 					c.String("network-id"),
 					edgeVPNClient.NewClient(edgeVPNClient.WithHost(c.String("api"))))
-				advertizing, _ := cc.AdvertizingNodes()
-				fmt.Println("Node\tRole")
-				for _, a := range advertizing {
-					role, _ := cc.Get("role", a)
-					fmt.Printf("%s\t%s\n", a, role)
+
+				var roles []nodeRole
+				err := waitFor(c.Context, c.Duration("wait"), func() (err error) {
+					roles, err = listRoles(cc)
+					return err
+				})
+				if err != nil {
+					return fmt.Errorf("network %s: %w", c.String("network-id"), err)
 				}
-				return nil
+
+				return printOutput(os.Stdout, c.String("output"), roles, func(w io.Writer) {
+					fmt.Fprintln(w, "Node\tRole")
+					for _, r := range roles {
+						fmt.Fprintf(w, "%s\t%s\n", r.UUID, r.Role)
+					}
+				})
 			},
 		},
 	},
 }
+
+type nodeRole struct {
+	UUID string `json:"uuid" yaml:"uuid"`
+	Role string `json:"role" yaml:"role"`
+}
+
+// listRoles returns the roles of the advertizing nodes.
+func listRoles(cc *service.Client) ([]nodeRole, error) {
+	advertizing, err := cc.AdvertizingNodes()
+	if err != nil {
+		return nil, fmt.Errorf("could not list nodes: %w", err)
+	}
+	if len(advertizing) == 0 {
+		return nil, errors.New("no nodes found")
+	}
+
+	roles := []nodeRole{}
+	for _, a := range advertizing {
+		role, _ := cc.Get("role", a)
+		roles = append(roles, nodeRole{UUID: a, Role: role})
+	}
+	return roles, nil
+}
@@ -4,12 +4,11 @@ import (
 	"fmt"
 	"os"
 	"runtime"
-	"strconv"
 
+	"github.com/kairos-io/provider-kairos/v2/internal/cli/token"
 	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
 
 	"github.com/kairos-io/kairos-sdk/schema"
-	"github.com/mudler/edgevpn/pkg/node"
 	"github.com/urfave/cli/v2"
 	"gopkg.in/yaml.v3"
 )
@@ -42,21 +41,41 @@ var CreateConfigCMD = cli.Command{
 
 	Usage: "Creates a pristine config file",
 	Description: `
-		Prints a vanilla YAML configuration on screen which can be used to bootstrap a kairos network.
+		Prints a YAML configuration on screen which can be used to bootstrap a kairos network.
+		Flags describe the cluster topology, and are validated before the config is generated.
+		With --output-dir, one config per node type is written instead, sharing the same token.
+		With --qr or --qr-output, the configuration is rendered as a QR code to scan onto devices.
 		`,
 	ArgsUsage: "Optionally takes a token rotation interval (seconds)",
+	Flags:     append(append(append([]cli.Flag{}, tokenMetadataFlags...), qrFlags...), createConfigFlags...),
 
 	Action: func(c *cli.Context) error {
-		l := int(^uint(0) >> 1)
-		if c.Args().Present() {
-			if i, err := strconv.Atoi(c.Args().Get(0)); err == nil {
-				l = i
+		m, err := tokenMetadata(c)
+		if err != nil {
+			return err
+		}
+		o := clusterOptionsFromFlags(c, token.Generate(tokenInterval(c), m), m.NetworkID)
+
+		if dir := c.String("output-dir"); dir != "" {
+			if c.Bool("qr") || c.String("qr-output") != "" {
+				return fmt.Errorf("QR codes can't be rendered with --output-dir")
+			}
+			files, err := writeNodeConfigs(o, dir)
+			for _, f := range files {
+				fmt.Println(f)
 			}
+			return err
 		}
-		cc := &providerConfig.Config{P2P: &providerConfig.P2P{NetworkToken: node.GenerateNewConnectionData(l).Base64()}}
-		y, _ := yaml.Marshal(cc)
-		fmt.Printf("#cloud-config\n\n%s", string(y))
-		return nil
+
+		cc, err := o.config("")
+		if err != nil {
+			return err
+		}
+		content, err := cloudConfig(cc)
+		if err != nil {
+			return err
+		}
+		return printWithQR(c, content)
 	},
 }
 
@@ -69,15 +88,14 @@ var GenerateTokenCMD = cli.Command{
 		Generates a new token which can be used to bootstrap a kairos network.
 		`,
 	ArgsUsage: "Optionally takes a token rotation interval (seconds)",
+	Flags:     tokenMetadataFlags,
 
 	Action: func(c *cli.Context) error {
-		l := int(^uint(0) >> 1)
-		if c.Args().Present() {
-			if i, err := strconv.Atoi(c.Args().Get(0)); err == nil {
-				l = i
-			}
+		m, err := tokenMetadata(c)
+		if err != nil {
+			return err
 		}
-		fmt.Println(node.GenerateNewConnectionData(l).Base64())
+		fmt.Println(token.Generate(tokenInterval(c), m))
 		return nil
 	},
 }
@@ -86,11 +104,24 @@ var ValidateSchemaCMD = cli.Command{
 	Name: "validate",
 	Action: func(c *cli.Context) error {
 		config := c.Args().First()
-		return schema.Validate(config)
+		if err := schema.Validate(config); err != nil {
+			return err
+		}
+		// The provider settings are checked on local files only
+		dat, err := os.ReadFile(config)
+		if err != nil {
+			return nil
+		}
+		cc := &providerConfig.Config{}
+		if err := yaml.Unmarshal(dat, cc); err != nil {
+			return err
+		}
+		return cc.Validate()
 	},
 	Usage: "Validates a cloud config file",
 	Description: `
 The validate command expects a configuration file as its only argument. Local files and URLs are accepted.
+The provider settings of local files are validated as well, as they are when the node bootstraps.
 		`,
 }
 
@@ -169,10 +200,37 @@ For all the example cases, see: https://kairos.io/docs/
 					return StartRecoveryService(c)
 				},
 			},
+			{
+				Name:      "pairing-relay",
+				UsageText: "pairing-relay",
+				Usage:     "Reports the install progress to the registering operator",
+				Hidden:    true,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "token",
+						EnvVars: []string{"TOKEN"},
+					},
+					&cli.StringFlag{
+						Name:    "state-dir",
+						EnvVars: []string{"STATE_DIR"},
+					},
+					&cli.IntFlag{
+						Name:    "agent-pid",
+						EnvVars: []string{"AGENT_PID"},
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return StartPairingRelay(c)
+				},
+			},
 			RegisterCMD(toolName),
 			BridgeCMD(toolName),
 			&GetKubeConfigCMD,
 			&RoleCMD,
+			&NodeCMD,
+			&OperatorKeyCMD,
+			&ClusterCMD,
+			&TokenCMD,
 			&CreateConfigCMD,
 			&GenerateTokenCMD,
 			&ValidateSchemaCMD,
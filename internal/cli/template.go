@@ -0,0 +1,167 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/kairos-io/provider-kairos/v2/internal/pairing"
+)
+
+// templateNode is the inventory entry of the node, as seen by the config template.
+type templateNode struct {
+	Name     string
+	Image    string
+	Device   string
+	Hostname string
+	Role     string
+	Labels   map[string]string
+}
+
+// templateData is the data the config is rendered with.
+type templateData struct {
+	Values map[string]string
+	Node   templateNode
+	Facts  pairing.Facts
+}
+
+// parseSet reads the k=v assignments of --set.
+func parseSet(assignments []string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, a := range assignments {
+		k, v, ok := strings.Cut(a, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid value '%s', expected key=value", a)
+		}
+		values[k] = v
+	}
+	return values, nil
+}
+
+func parseConfig(name, tmpl string) (*template.Template, error) {
+	t, err := template.New(name).Funcs(sprig.TxtFuncMap()).Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config template: %w", err)
+	}
+	return t, nil
+}
+
+// needsFacts tells whether the template uses the facts the node reports during pairing,
+// looking for the .Facts and $.Facts fields. A template which doesn't parse doesn't, as
+// it fails to render anyway.
+func needsFacts(tmpl string) bool {
+	t, err := parseConfig("config", tmpl)
+	if err != nil {
+		return false
+	}
+	for _, d := range t.Templates() {
+		if d.Tree != nil && usesFacts(d.Tree.Root) {
+			return true
+		}
+	}
+	return false
+}
+
+func usesFacts(n parse.Node) bool {
+	switch n := n.(type) {
+	case *parse.FieldNode:
+		return n.Ident[0] == "Facts"
+	case *parse.VariableNode:
+		return len(n.Ident) > 1 && n.Ident[0] == "$" && n.Ident[1] == "Facts"
+	case *parse.ChainNode:
+		return usesFacts(n.Node)
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Nodes {
+			if usesFacts(c) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return usesFacts(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Cmds {
+			if usesFacts(c) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			if usesFacts(a) {
+				return true
+			}
+		}
+	case *parse.IfNode:
+		return usesFacts(&n.BranchNode)
+	case *parse.RangeNode:
+		return usesFacts(&n.BranchNode)
+	case *parse.WithNode:
+		return usesFacts(&n.BranchNode)
+	case *parse.BranchNode:
+		return usesFacts(n.Pipe) || usesFacts(n.List) || usesFacts(n.ElseList)
+	case *parse.TemplateNode:
+		return usesFacts(n.Pipe)
+	}
+	return false
+}
+
+// renderConfig renders the config template. Missing values are errors,
+// rather than silently empty settings.
+func renderConfig(name, tmpl string, data templateData) (string, error) {
+	t, err := parseConfig(name, tmpl)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, data); err != nil {
+		return "", fmt.Errorf("could not render the config: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// registration is the payload of a node. With Template, the config is rendered
+// once the facts of the node are known.
+type registration struct {
+	Name      string
+	Config    string
+	Template  bool
+	Data      templateData
+	Overrides inventoryNode
+	Device    string
+	Reboot    bool
+	Poweroff  bool
+}
+
+// payload renders and validates the payload of the node.
+func (r registration) payload(facts pairing.Facts) (map[string]string, error) {
+	cc := r.Config
+	if r.Template {
+		data := r.Data
+		data.Facts = facts
+		var err error
+		if cc, err = renderConfig(r.Name, r.Config, data); err != nil {
+			return nil, err
+		}
+	} else if len(r.Data.Values) > 0 {
+		return nil, errors.New("values are only used to render a config template, set --template")
+	}
+	cc, err := applyOverrides(cc, r.Overrides)
+	if err != nil {
+		return nil, fmt.Errorf("could not apply the node overrides: %w", err)
+	}
+
+	payload := pairingPayload(cc, r.Device, r.Reboot, r.Poweroff)
+	if errs := pairing.ValidatePayload(payload); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid configuration:\n  - %s", strings.Join(errs, "\n  - "))
+	}
+	return payload, nil
+}
@@ -0,0 +1,82 @@
+package cli
+
+import (
+	"github.com/kairos-io/provider-kairos/v2/internal/pairing"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config templates", func() {
+	It("parses the --set values", func() {
+		Expect(parseSet([]string{"ip=10.0.0.1", "args=a=b", "empty="})).To(Equal(map[string]string{"ip": "10.0.0.1", "args": "a=b", "empty": ""}))
+		_, err := parseSet([]string{"ip"})
+		Expect(err).To(MatchError("invalid value 'ip', expected key=value"))
+	})
+
+	Context("renderConfig", func() {
+		data := templateData{
+			Values: map[string]string{"ip": "10.0.0.1"},
+			Node:   templateNode{Name: "node1", Role: "master"},
+			Facts:  pairing.Facts{MAC: "aa:bb:cc:dd:ee:ff"},
+		}
+
+		It("renders the values, the node and the facts with sprig", func() {
+			Expect(renderConfig("config.yaml", `ip: {{ .Values.ip }}
+name: {{ .Node.Name | upper }}
+mac: {{ .Facts.MAC | replace ":" "" }}
+`, data)).To(Equal("ip: 10.0.0.1\nname: NODE1\nmac: aabbccddeeff\n"))
+		})
+
+		It("fails on missing values", func() {
+			_, err := renderConfig("config.yaml", "ip: {{ .Values.gateway }}", data)
+			Expect(err).To(MatchError(ContainSubstring(`map has no entry for key "gateway"`)))
+			_, err = renderConfig("config.yaml", "ip: {{ .Values.ip ", data)
+			Expect(err).To(MatchError(ContainSubstring("invalid config template")))
+		})
+	})
+
+	It("tells whether the node facts are required", func() {
+		Expect(needsFacts("hostname: node-{{ .Facts.Serial }}")).To(BeTrue())
+		Expect(needsFacts("hostname: node-{{ $.Facts.Serial }}")).To(BeTrue())
+		Expect(needsFacts("{{ with .Facts }}hostname: {{ .MAC }}{{ end }}")).To(BeTrue())
+		Expect(needsFacts("hostname: {{ .Node.Hostname }}")).To(BeFalse())
+		Expect(needsFacts("hostname: node-{{\"{{\"}} .Facts.Serial }}")).To(BeFalse())
+	})
+
+	Context("registration", func() {
+		It("renders, overrides and validates the payload", func() {
+			r := registration{
+				Name:      "config.yaml",
+				Config:    "#cloud-config\np2p:\n  network_token: {{ .Values.token }}\n",
+				Template:  true,
+				Data:      templateData{Values: map[string]string{"token": "foo"}},
+				Overrides: inventoryNode{Role: "worker"},
+				Device:    "/dev/sda",
+				Reboot:    true,
+			}
+			payload, err := r.payload(pairing.Facts{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(payload).To(HaveKeyWithValue("device", "/dev/sda"))
+			Expect(payload).To(HaveKey("reboot"))
+			Expect(payload["cc"]).To(ContainSubstring("network_token: foo"))
+			Expect(payload["cc"]).To(ContainSubstring("role: worker"))
+		})
+
+		It("rejects invalid rendered configs", func() {
+			r := registration{Name: "config.yaml", Config: "p2p:\n  role: {{ .Values.role }}\n", Template: true, Data: templateData{Values: map[string]string{"role": "foo"}}}
+			_, err := r.payload(pairing.Facts{})
+			Expect(err).To(MatchError(ContainSubstring("invalid configuration:\n  - invalid p2p.role 'foo'")))
+		})
+
+		It("leaves the config as it is without Template", func() {
+			r := registration{Name: "config.yaml", Config: "#cloud-config\nhostname: node-{{ trunc 4 .Random }}\n"}
+			payload, err := r.payload(pairing.Facts{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(payload["cc"]).To(ContainSubstring("hostname: node-{{ trunc 4 .Random }}"))
+
+			r.Data.Values = map[string]string{"ip": "10.0.0.1"}
+			_, err = r.payload(pairing.Facts{})
+			Expect(err).To(MatchError(ContainSubstring("set --template")))
+		})
+	})
+})
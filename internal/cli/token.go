@@ -0,0 +1,201 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/kairos-io/provider-kairos/v2/internal/cli/token"
+	"github.com/kairos-io/provider-kairos/v2/internal/cluster"
+	"github.com/kairos-io/provider-kairos/v2/internal/operator"
+	edgeVPNClient "github.com/mudler/edgevpn/api/client"
+	"github.com/mudler/edgevpn/api/client/service"
+	"github.com/urfave/cli/v2"
+)
+
+// parseTime parses either an absolute RFC3339 time or a delay from now.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time '%s': expected a duration or an RFC3339 time", s)
+	}
+	return t, nil
+}
+
+var tokenMetadataFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "network-id",
+		Usage: "Network ID the token is meant for",
+	},
+	&cli.StringFlag{
+		Name:  "expires",
+		Usage: "Expiration of the token, as a delay (e.g. 720h) or an RFC3339 time",
+	},
+	&cli.StringFlag{
+		Name:  "description",
+		Usage: "Free text describing the token, e.g. the site it is used for",
+	},
+}
+
+func tokenMetadata(c *cli.Context) (token.Metadata, error) {
+	m := token.Metadata{
+		NetworkID:   c.String("network-id"),
+		Description: c.String("description"),
+	}
+	if c.String("expires") != "" {
+		expires, err := parseTime(c.String("expires"), time.Now())
+		if err != nil {
+			return m, err
+		}
+		expires = expires.UTC()
+		m.Expires = &expires
+	}
+	return m, nil
+}
+
+// tokenInterval returns the OTP rotation interval given as first argument, if any.
+func tokenInterval(c *cli.Context) int {
+	if c.Args().Present() {
+		if i, err := strconv.Atoi(c.Args().Get(0)); err == nil {
+			return i
+		}
+	}
+	return token.MaxInterval
+}
+
+func printTokenInfo(w io.Writer, i token.Info) {
+	fmt.Fprintf(w, "Fingerprint:      %s\n", i.Fingerprint)
+	if m := i.Metadata; m != nil {
+		fmt.Fprintf(w, "Network ID:       %s\n", m.NetworkID)
+		fmt.Fprintf(w, "Description:      %s\n", m.Description)
+		if m.Expires != nil {
+			fmt.Fprintf(w, "Expires:          %s\n", m.Expires.Local().Format(time.RFC3339))
+		}
+	}
+	fmt.Fprintf(w, "Room:             %s\n", i.Room)
+	fmt.Fprintf(w, "Rendezvous:       %s\n", i.Rendezvous)
+	fmt.Fprintf(w, "mDNS:             %s\n", i.MDNS)
+	fmt.Fprintf(w, "DHT OTP:          every %ds, length %d\n", i.DHTInterval, i.DHTKeyLength)
+	fmt.Fprintf(w, "Crypto OTP:       every %ds, length %d\n", i.CryptoInterval, i.CryptoLength)
+	fmt.Fprintf(w, "Max message size: %d\n", i.MaxMessageSize)
+
+	if len(i.Warnings) > 0 {
+		fmt.Fprintln(w)
+	}
+	for _, warning := range i.Warnings {
+		fmt.Fprintf(w, "WARNING: %s\n", warning)
+	}
+}
+
+var TokenCMD = cli.Command{
+	Name:  "token",
+	Usage: "Manage the network token",
+	Subcommands: []*cli.Command{
+		{
+			Flags:     []cli.Flag{outputFlag},
+			Name:      "inspect",
+			Usage:     "Show the settings of a network token",
+			UsageText: "kairos token inspect [--output table|json|yaml] <token>",
+			Description: `
+		Decodes the edgevpn connection data of the token. The OTP keys are not shown,
+		the fingerprint identifies the token and is safe to log.
+		`,
+			Action: func(c *cli.Context) error {
+				t := c.Args().First()
+				if t == "" {
+					return fmt.Errorf("a token is required")
+				}
+				info, err := token.Inspect(t, time.Now())
+				if err != nil {
+					return err
+				}
+				return printOutput(os.Stdout, c.String("output"), info, func(w io.Writer) { printTokenInfo(w, info) })
+			},
+		},
+		{
+			Flags:     qrOutputFlags,
+			Name:      "qr",
+			Usage:     "Render a network token as a QR code",
+			UsageText: "kairos token qr [--qr-output <file.png>] <token>",
+			Action: func(c *cli.Context) error {
+				t := c.Args().First()
+				if t == "" {
+					return fmt.Errorf("a token is required")
+				}
+				if _, err := token.Decode(t); err != nil {
+					return err
+				}
+				return writeQR(os.Stdout, t, c.String("qr-output"), c.Bool("qr-invert"))
+			},
+		},
+		{
+			Flags: append([]cli.Flag{
+				&cli.StringFlag{
+					Name:  "new-token",
+					Usage: "The token to switch to. A new one is generated if not given",
+				},
+				&cli.StringFlag{
+					Name:  "at",
+					Usage: "When the nodes switch token, as a delay (e.g. 10m) or an RFC3339 time",
+					Value: "5m",
+				},
+				signKeyFlag,
+			}, networkAPI...),
+			Name:      "rotate",
+			Usage:     "Rotate the network token on all the nodes",
+			UsageText: "kairos token rotate --sign-key operator.key [--new-token <token>] [--at <time>]",
+			Description: `
+		Publishes the new token to the ledger, signed with an operator key. At the given
+		time, every node replaces the token in its configuration and restarts edgevpn,
+		so that the nodes move to the new network together. Nodes offline at that time
+		keep the old token.
+
+		Nodes only apply rotations signed with a key listed in their config:
+
+		  p2p:
+		    token_rotation:
+		      trusted_keys:
+		      - <public key>
+
+		This doesn't evict the holders of the current token: the new token is published
+		on the current network, so whoever can read it there learns the new one too. To
+		revoke access, reinstall the nodes with a new token instead.
+		`,
+			Action: func(c *cli.Context) error {
+				at, err := parseTime(c.String("at"), time.Now())
+				if err != nil {
+					return err
+				}
+				key, err := operator.ReadKey(c.String("sign-key"))
+				if err != nil {
+					return err
+				}
+
+				newToken := c.String("new-token")
+				if newToken == "" {
+					newToken = token.Generate(token.MaxInterval, token.Metadata{NetworkID: c.String("network-id")})
+				} else if _, err := token.Decode(newToken); err != nil {
+					return err
+				}
+
+				cc := service.NewClient(
+					c.String("network-id"),
+					edgeVPNClient.NewClient(edgeVPNClient.WithHost(c.String("api"))))
+				if err := cluster.PublishTokenRotation(cc, cluster.TokenRotation{Token: newToken, At: at.UTC()}.Sign(key)); err != nil {
+					return fmt.Errorf("could not publish the token rotation: %w", err)
+				}
+
+				fmt.Printf("Token rotation scheduled at %s\n", at.Local().Format(time.RFC3339))
+				if c.String("new-token") == "" {
+					fmt.Printf("New token: %s\n", newToken)
+				}
+				return nil
+			},
+		},
+	},
+}
@@ -0,0 +1,123 @@
+package token
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/mudler/edgevpn/pkg/node"
+	"gopkg.in/yaml.v3"
+)
+
+// MaxInterval is the OTP interval used when none is given, which disables key rotation.
+const MaxInterval = int(^uint(0) >> 1)
+
+// minKeyLength is the shortest OTP key length not reported as insecure.
+const minKeyLength = 32
+
+// Metadata is embedded in the token to help matching it to a site.
+// edgevpn ignores it when reading the connection data.
+type Metadata struct {
+	NetworkID   string     `yaml:"network_id,omitempty" json:"network_id,omitempty"`
+	Expires     *time.Time `yaml:"expires,omitempty" json:"expires,omitempty"`
+	Description string     `yaml:"description,omitempty" json:"description,omitempty"`
+}
+
+// Token is the edgevpn connection data, with the optional kairos metadata.
+type Token struct {
+	node.YAMLConnectionConfig `yaml:",inline"`
+	Kairos                    *Metadata `yaml:"kairos,omitempty"`
+}
+
+// Generate returns a new network token rotating OTP keys at the given interval (seconds).
+func Generate(interval int, m Metadata) string {
+	t := Token{YAMLConnectionConfig: *node.GenerateNewConnectionData(interval)}
+	if m != (Metadata{}) {
+		t.Kairos = &m
+	}
+	dat, _ := yaml.Marshal(t)
+	return base64.StdEncoding.EncodeToString(dat)
+}
+
+// Decode reads a network token.
+func Decode(token string) (*Token, error) {
+	dat, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	t := &Token{}
+	if err := yaml.Unmarshal(dat, t); err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	if t.OTP.Crypto.Key == "" || t.RoomName == "" {
+		return nil, fmt.Errorf("invalid token: no connection data")
+	}
+	return t, nil
+}
+
+// Fingerprint identifies a token without disclosing it, so it is safe to log.
+func Fingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// Info is the content of a token, without the OTP keys.
+type Info struct {
+	Fingerprint    string    `yaml:"fingerprint" json:"fingerprint"`
+	Metadata       *Metadata `yaml:"metadata,omitempty" json:"metadata,omitempty"`
+	Room           string    `yaml:"room" json:"room"`
+	Rendezvous     string    `yaml:"rendezvous" json:"rendezvous"`
+	MDNS           string    `yaml:"mdns" json:"mdns"`
+	DHTInterval    int       `yaml:"dht_otp_interval" json:"dht_otp_interval"`
+	DHTKeyLength   int       `yaml:"dht_otp_length" json:"dht_otp_length"`
+	CryptoInterval int       `yaml:"crypto_otp_interval" json:"crypto_otp_interval"`
+	CryptoLength   int       `yaml:"crypto_otp_length" json:"crypto_otp_length"`
+	MaxMessageSize int       `yaml:"max_message_size" json:"max_message_size"`
+	Warnings       []string  `yaml:"warnings,omitempty" json:"warnings,omitempty"`
+}
+
+// Inspect decodes a token and reports its insecure settings.
+func Inspect(token string, now time.Time) (Info, error) {
+	t, err := Decode(token)
+	if err != nil {
+		return Info{}, err
+	}
+
+	return Info{
+		Fingerprint:    Fingerprint(token),
+		Metadata:       t.Kairos,
+		Room:           t.RoomName,
+		Rendezvous:     t.Rendezvous,
+		MDNS:           t.MDNS,
+		DHTInterval:    t.OTP.DHT.Interval,
+		DHTKeyLength:   t.OTP.DHT.Length,
+		CryptoInterval: t.OTP.Crypto.Interval,
+		CryptoLength:   t.OTP.Crypto.Length,
+		MaxMessageSize: t.MaxMessageSize,
+		Warnings:       warnings(t, now),
+	}, nil
+}
+
+func warnings(t *Token, now time.Time) []string {
+	res := []string{}
+	for _, name := range []string{"DHT", "crypto"} {
+		otp := t.OTP.DHT
+		if name == "crypto" {
+			otp = t.OTP.Crypto
+		}
+		switch {
+		case otp.Interval >= MaxInterval:
+			res = append(res, fmt.Sprintf("%s OTP keys never rotate", name))
+		case otp.Interval > 24*3600:
+			res = append(res, fmt.Sprintf("%s OTP keys rotate every %dh", name, otp.Interval/3600))
+		}
+		if otp.Length < minKeyLength {
+			res = append(res, fmt.Sprintf("%s OTP key length %d is shorter than %d", name, otp.Length, minKeyLength))
+		}
+	}
+	if t.Kairos != nil && t.Kairos.Expires != nil && now.After(*t.Kairos.Expires) {
+		res = append(res, fmt.Sprintf("token expired on %s", t.Kairos.Expires.Format(time.RFC3339)))
+	}
+	return res
+}
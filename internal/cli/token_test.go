@@ -0,0 +1,70 @@
+package cli
+
+import (
+	"time"
+
+	"github.com/kairos-io/provider-kairos/v2/internal/cli/token"
+	"github.com/mudler/edgevpn/pkg/node"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Token rotation", func() {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	It("accepts a delay or an absolute time", func() {
+		t, err := parseTime("10m", now)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t).To(Equal(now.Add(10 * time.Minute)))
+
+		t, err = parseTime("2024-01-02T08:00:00Z", now)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t).To(Equal(time.Date(2024, 1, 2, 8, 0, 0, 0, time.UTC)))
+
+		_, err = parseTime("tomorrow", now)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Token inspection", func() {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	It("embeds metadata which edgevpn ignores", func() {
+		expires := now.Add(time.Hour)
+		t := token.Generate(3600, token.Metadata{NetworkID: "site-a", Description: "lab", Expires: &expires})
+
+		info, err := token.Inspect(t, now)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Metadata.NetworkID).To(Equal("site-a"))
+		Expect(info.Metadata.Description).To(Equal("lab"))
+		Expect(info.Metadata.Expires.Equal(expires)).To(BeTrue())
+		Expect(info.CryptoInterval).To(Equal(3600))
+		Expect(info.Fingerprint).To(Equal(token.Fingerprint(t)))
+		Expect(info.Warnings).To(BeEmpty())
+
+		cfg := &node.Config{}
+		Expect(node.FromBase64(false, true, t, nil, nil)(cfg)).To(Succeed())
+		Expect(cfg.RoomName).To(Equal(info.Room))
+		Expect(cfg.SealKeyInterval).To(Equal(3600))
+	})
+
+	It("warns about keys which never rotate and expired tokens", func() {
+		expires := now.Add(-time.Hour)
+		info, err := token.Inspect(token.Generate(token.MaxInterval, token.Metadata{Expires: &expires}), now)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Warnings).To(Equal([]string{
+			"DHT OTP keys never rotate",
+			"crypto OTP keys never rotate",
+			"token expired on 2024-01-01T11:00:00Z",
+		}))
+	})
+
+	It("reads tokens without metadata and rejects invalid ones", func() {
+		info, err := token.Inspect(node.GenerateNewConnectionData(60).Base64(), now)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Metadata).To(BeNil())
+
+		_, err = token.Inspect("not a token", now)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,32 @@
+package cli
+
+import (
+	"context"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+var waitInterval = 5 * time.Second
+
+var waitFlag = &cli.DurationFlag{
+	Name:  "wait",
+	Usage: "Wait up to the given duration (e.g. 10m) for the data to be published",
+}
+
+// waitFor calls fn until it succeeds or the timeout expires, returning the last error.
+// With a zero timeout fn is called once.
+func waitFor(ctx context.Context, timeout time.Duration, fn func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := fn()
+		if err == nil || !time.Now().Before(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(waitInterval):
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package cluster
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/mudler/edgevpn/api/client/service"
+)
+
+// TokenRotation is a network token change scheduled for all the nodes, signed with an operator key.
+type TokenRotation struct {
+	Token     string    `json:"token"`
+	At        time.Time `json:"at"`
+	Key       string    `json:"key,omitempty"`
+	Signature string    `json:"signature,omitempty"`
+}
+
+func (r TokenRotation) message() []byte {
+	return []byte(fmt.Sprintf("kairos-token-rotation-v1\n%s\n%s", r.Token, r.At.UTC().Format(time.RFC3339Nano)))
+}
+
+// Sign returns the rotation signed with the operator key.
+func (r TokenRotation) Sign(key ed25519.PrivateKey) TokenRotation {
+	r.Key = base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	r.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, r.message()))
+	return r
+}
+
+// Verify checks that the rotation is signed with one of the trusted keys, as any
+// node of the network can publish one.
+func (r TokenRotation) Verify(trusted []string) error {
+	if r.Signature == "" {
+		return errors.New("the token rotation is not signed")
+	}
+	if !slices.Contains(trusted, r.Key) {
+		return fmt.Errorf("the token rotation is signed with the untrusted key '%s'", r.Key)
+	}
+	pub, err := base64.StdEncoding.DecodeString(r.Key)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid token rotation key '%s'", r.Key)
+	}
+	sig, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil || !ed25519.Verify(pub, r.message(), sig) {
+		return errors.New("invalid token rotation signature")
+	}
+	return nil
+}
+
+// Due returns true once the rotation time has come.
+func (r TokenRotation) Due(now time.Time) bool {
+	return !now.Before(r.At)
+}
+
+// PublishTokenRotation schedules the token rotation in the ledger.
+func PublishTokenRotation(client *service.Client, r TokenRotation) error {
+	dat, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return client.Set("rotation", "token", string(dat))
+}
+
+// GetTokenRotation returns the token rotation published in the ledger, if any.
+func GetTokenRotation(client *service.Client) (*TokenRotation, error) {
+	dat, _ := client.Get("rotation", "token")
+	if dat == "" {
+		return nil, nil
+	}
+	r := &TokenRotation{}
+	if err := json.Unmarshal([]byte(dat), r); err != nil {
+		return nil, fmt.Errorf("invalid token rotation: %w", err)
+	}
+	return r, nil
+}
@@ -0,0 +1,37 @@
+package cluster
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Token rotation", func() {
+	It("is due once its time has come", func() {
+		at := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+		r := TokenRotation{Token: "new", At: at}
+		Expect(r.Due(at.Add(-time.Second))).To(BeFalse())
+		Expect(r.Due(at)).To(BeTrue())
+		Expect(r.Due(at.Add(time.Hour))).To(BeTrue())
+	})
+
+	It("is verified against the trusted keys", func() {
+		_, operator, err := ed25519.GenerateKey(nil)
+		Expect(err).ToNot(HaveOccurred())
+		_, other, err := ed25519.GenerateKey(nil)
+		Expect(err).ToNot(HaveOccurred())
+		trusted := []string{base64.StdEncoding.EncodeToString(operator.Public().(ed25519.PublicKey))}
+
+		r := TokenRotation{Token: "new", At: time.Now()}
+		Expect(r.Verify(trusted)).To(MatchError("the token rotation is not signed"))
+		Expect(r.Sign(operator).Verify(trusted)).To(Succeed())
+		Expect(r.Sign(other).Verify(trusted)).To(MatchError(ContainSubstring("untrusted key")))
+
+		tampered := r.Sign(operator)
+		tampered.Token = "other"
+		Expect(tampered.Verify(trusted)).To(MatchError("invalid token rotation signature"))
+	})
+})
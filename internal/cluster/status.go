@@ -0,0 +1,135 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/mudler/edgevpn/api/client/service"
+	"github.com/samber/lo"
+)
+
+// NodeInfoKey is the ledger key where nodes publish their NodeInfo.
+const NodeInfoKey = "nodeinfo"
+
+// NodeInfo are the details published by each node for the cluster status.
+type NodeInfo struct {
+	Hostname   string `json:"hostname,omitempty"`
+	VPNIP      string `json:"vpn_ip,omitempty"`
+	Configured bool   `json:"configured"`
+	// HATarget is the number of master/ha nodes the node is configured for.
+	HATarget int `json:"ha_target,omitempty"`
+}
+
+type Node struct {
+	UUID         string `json:"uuid" yaml:"uuid"`
+	Hostname     string `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	Role         string `json:"role,omitempty" yaml:"role,omitempty"`
+	Advertizing  bool   `json:"advertizing" yaml:"advertizing"`
+	Active       bool   `json:"active" yaml:"active"`
+	Leader       bool   `json:"leader" yaml:"leader"`
+	VPNIP        string `json:"vpn_ip,omitempty" yaml:"vpn_ip,omitempty"`
+	Bootstrapped bool   `json:"bootstrapped" yaml:"bootstrapped"`
+}
+
+type Status struct {
+	NetworkID  string   `json:"network_id" yaml:"network_id"`
+	Leader     string   `json:"leader,omitempty" yaml:"leader,omitempty"`
+	MasterIP   string   `json:"master_ip,omitempty" yaml:"master_ip,omitempty"`
+	Kubeconfig bool     `json:"kubeconfig" yaml:"kubeconfig"`
+	Nodes      []Node   `json:"nodes" yaml:"nodes"`
+	Warnings   []string `json:"warnings,omitempty" yaml:"warnings,omitempty"`
+}
+
+func isMaster(role string) bool {
+	return role == "master" || role == "master/clusterinit"
+}
+
+// GetStatus reads the state of the network from the ledger.
+func GetStatus(client *service.Client, networkID string) (Status, error) {
+	advertizing, err := client.AdvertizingNodes()
+	if err != nil {
+		return Status{}, fmt.Errorf("could not list nodes: %w", err)
+	}
+	active, _ := client.ActiveNodes()
+	assigned, _ := client.ListItems(networkID, "role")
+
+	s := Status{NetworkID: networkID}
+	s.Leader, _ = client.Get("auto", "leader")
+	s.MasterIP, _ = client.Get("master", "ip")
+	kubeconfig, _ := client.Get("kubeconfig", "master")
+	s.Kubeconfig = kubeconfig != ""
+
+	haTarget := 0
+	for _, uuid := range lo.Uniq(append(append([]string{}, advertizing...), assigned...)) {
+		n := Node{
+			UUID:        uuid,
+			Advertizing: lo.Contains(advertizing, uuid),
+			Active:      lo.Contains(active, uuid),
+			Leader:      uuid == s.Leader,
+		}
+		n.Role, _ = client.Get("role", uuid)
+
+		info := NodeInfo{}
+		if dat, _ := client.Get(NodeInfoKey, uuid); dat != "" {
+			json.Unmarshal([]byte(dat), &info) //nolint:errcheck
+		}
+		n.Hostname = info.Hostname
+		n.VPNIP = info.VPNIP
+		n.Bootstrapped = info.Configured
+		if info.HATarget > haTarget {
+			haTarget = info.HATarget
+		}
+
+		s.Nodes = append(s.Nodes, n)
+	}
+
+	sort.Slice(s.Nodes, func(i, j int) bool { return s.Nodes[i].UUID < s.Nodes[j].UUID })
+	s.Warnings = warnings(s, haTarget)
+	return s, nil
+}
+
+func warnings(s Status, haTarget int) []string {
+	res := []string{}
+	if len(s.Nodes) == 0 {
+		return append(res, "no nodes found on the network")
+	}
+
+	if s.Leader == "" {
+		res = append(res, "no auto leader elected")
+	} else if !lo.ContainsBy(s.Nodes, func(n Node) bool { return n.UUID == s.Leader && n.Advertizing }) {
+		res = append(res, fmt.Sprintf("leader %s is not advertizing", s.Leader))
+	}
+
+	haMasters := 0
+	master := false
+	for _, n := range s.Nodes {
+		if n.Role == "master/ha" {
+			haMasters++
+		}
+		if isMaster(n.Role) {
+			master = true
+		}
+		switch {
+		case !n.Advertizing:
+			res = append(res, fmt.Sprintf("node %s has role %s but is not advertizing", n.UUID, n.Role))
+		case !n.Active:
+			res = append(res, fmt.Sprintf("node %s is not active", n.UUID))
+		case n.Role == "":
+			res = append(res, fmt.Sprintf("node %s has no role assigned", n.UUID))
+		}
+	}
+
+	if !master {
+		res = append(res, "no master assigned")
+	} else if s.MasterIP == "" {
+		res = append(res, "master IP not published")
+	}
+	if master && !s.Kubeconfig {
+		res = append(res, "kubeconfig not published")
+	}
+	if haTarget > 0 && haMasters < haTarget {
+		res = append(res, fmt.Sprintf("HA target %d, have %d", haTarget, haMasters))
+	}
+	return res
+}
@@ -0,0 +1,54 @@
+package cluster
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cluster status", func() {
+	node := func(uuid, role string) Node {
+		return Node{UUID: uuid, Role: role, Advertizing: true, Active: true}
+	}
+
+	It("reports a formed cluster without warnings", func() {
+		s := Status{
+			Leader:     "a",
+			MasterIP:   "10.1.0.1",
+			Kubeconfig: true,
+			Nodes:      []Node{node("a", "master"), node("b", "worker")},
+		}
+		Expect(warnings(s, 0)).To(BeEmpty())
+	})
+
+	It("warns about a cluster which never formed", func() {
+		b := node("b", "")
+		b.Active = false
+		s := Status{Nodes: []Node{node("a", ""), b}}
+		Expect(warnings(s, 0)).To(ConsistOf(
+			"no auto leader elected",
+			"node a has no role assigned",
+			"node b is not active",
+			"no master assigned",
+		))
+	})
+
+	It("warns about missing HA masters and master data", func() {
+		gone := node("d", "master/ha")
+		gone.Advertizing = false
+		s := Status{
+			Leader: "x",
+			Nodes:  []Node{node("a", "master/clusterinit"), node("b", "master/ha"), node("c", "worker"), gone},
+		}
+		Expect(warnings(s, 3)).To(ConsistOf(
+			"leader x is not advertizing",
+			"node d has role master/ha but is not advertizing",
+			"master IP not published",
+			"kubeconfig not published",
+			"HA target 3, have 2",
+		))
+	})
+
+	It("warns when no node is found", func() {
+		Expect(warnings(Status{}, 0)).To(Equal([]string{"no nodes found on the network"}))
+	})
+})
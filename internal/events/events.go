@@ -0,0 +1,148 @@
+package events
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	edgeVPNClient "github.com/mudler/edgevpn/api/client"
+	"github.com/mudler/edgevpn/api/client/service"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// MaxEvents is the number of events kept in the ledger for each node.
+var MaxEvents = 50
+
+// Event is a bootstrap step run by a node.
+type Event struct {
+	Time    time.Time `json:"time" yaml:"time"`
+	UUID    string    `json:"uuid" yaml:"uuid"`
+	Role    string    `json:"role,omitempty" yaml:"role,omitempty"`
+	Step    string    `json:"step" yaml:"step"`
+	Outcome string    `json:"outcome" yaml:"outcome"`
+	Error   string    `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// Bucket is the ledger bucket holding the events of a network, keyed by node UUID.
+func Bucket(networkID string) string {
+	return fmt.Sprintf("%s-events", networkID)
+}
+
+// Recorder appends the events of a node to the ledger. Events are kept until
+// the ledger accepts them, as steps can run before the API is available.
+type Recorder struct {
+	sync.Mutex
+
+	client *edgeVPNClient.Client
+	bucket string
+	uuid   string
+
+	loaded  bool
+	dirty   bool
+	events  []Event
+	last    map[string]Event
+	nowFunc func() time.Time
+}
+
+func NewRecorder(client *edgeVPNClient.Client, networkID, uuid string) *Recorder {
+	return &Recorder{
+		client:  client,
+		bucket:  Bucket(networkID),
+		uuid:    uuid,
+		last:    map[string]Event{},
+		nowFunc: time.Now,
+	}
+}
+
+// Record appends the outcome of a step. Consecutive runs of a step with the
+// same outcome are recorded once, as roles run on every iteration of the node loop.
+func (r *Recorder) Record(role, step string, err error) error {
+	r.Lock()
+	defer r.Unlock()
+
+	e := Event{UUID: r.uuid, Role: role, Step: step, Outcome: OutcomeSuccess}
+	if err != nil {
+		e.Outcome = OutcomeFailure
+		e.Error = err.Error()
+	}
+
+	if prev, ok := r.last[step]; !ok || prev.Role != e.Role || prev.Outcome != e.Outcome || prev.Error != e.Error {
+		e.Time = r.nowFunc().UTC()
+		r.last[step] = e
+		r.events = append(r.events, e)
+		if len(r.events) > MaxEvents {
+			r.events = r.events[len(r.events)-MaxEvents:]
+		}
+		r.dirty = true
+	}
+
+	return r.flush()
+}
+
+func (r *Recorder) flush() error {
+	if !r.loaded {
+		// Keep the history published before a restart
+		published, err := r.client.GetBucket(r.bucket)
+		if err != nil {
+			return err
+		}
+		var previous []Event
+		if data, exists := published[r.uuid]; exists && data.Unmarshal(&previous) == nil {
+			r.events = append(previous, r.events...)
+			if len(r.events) > MaxEvents {
+				r.events = r.events[len(r.events)-MaxEvents:]
+			}
+		}
+		r.loaded = true
+	}
+
+	if !r.dirty {
+		return nil
+	}
+	if err := r.client.Put(r.bucket, r.uuid, r.events); err != nil {
+		return err
+	}
+	r.dirty = false
+	return nil
+}
+
+// Role wraps a node role, recording its outcome as the given step.
+func (r *Recorder) Role(name, step string, role func(*service.RoleConfig) error) func(*service.RoleConfig) error {
+	return func(c *service.RoleConfig) error {
+		err := role(c)
+		if rerr := r.Record(name, step, err); rerr != nil {
+			c.Logger.Debugf("Failed publishing events: %s", rerr.Error())
+		}
+		return err
+	}
+}
+
+// List returns the events of the network sorted by time, optionally for one node only.
+func List(client *edgeVPNClient.Client, networkID, node string) ([]Event, error) {
+	bucket, err := client.GetBucket(Bucket(networkID))
+	if err != nil {
+		return nil, err
+	}
+
+	res := []Event{}
+	for uuid, data := range bucket {
+		if node != "" && uuid != node {
+			continue
+		}
+		var events []Event
+		if err := data.Unmarshal(&events); err != nil {
+			continue
+		}
+		res = append(res, events...)
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Time.Before(res[j].Time)
+	})
+	return res, nil
+}
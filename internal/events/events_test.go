@@ -0,0 +1,118 @@
+package events_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	. "github.com/kairos-io/provider-kairos/v2/internal/events"
+	edgeVPNClient "github.com/mudler/edgevpn/api/client"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// fakeLedger serves the ledger endpoints of the edgevpn API used by the recorder.
+type fakeLedger struct {
+	sync.Mutex
+	buckets map[string]map[string]string
+	puts    int
+	down    bool
+}
+
+func (f *fakeLedger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/ledger/"), "/")
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(f.buckets[parts[0]]) //nolint:errcheck
+	case http.MethodPut:
+		v, _ := base64.URLEncoding.DecodeString(parts[2])
+		if f.buckets[parts[0]] == nil {
+			f.buckets[parts[0]] = map[string]string{}
+		}
+		f.buckets[parts[0]][parts[1]] = string(v)
+		f.puts++
+		w.Write([]byte(`{"State":"Announcing"}`)) //nolint:errcheck
+	}
+}
+
+var _ = Describe("Events", func() {
+	var (
+		ledger *fakeLedger
+		server *httptest.Server
+		client *edgeVPNClient.Client
+	)
+
+	BeforeEach(func() {
+		ledger = &fakeLedger{buckets: map[string]map[string]string{}}
+		server = httptest.NewServer(ledger)
+		client = edgeVPNClient.NewClient(edgeVPNClient.WithHost(server.URL))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("records outcome changes only", func() {
+		r := NewRecorder(client, "kairos", "node-a")
+		Expect(r.Record("", "vpn", nil)).To(Succeed())
+		Expect(r.Record("worker", "kubernetes", errors.New("no master yet"))).To(Succeed())
+		Expect(r.Record("worker", "kubernetes", errors.New("no master yet"))).To(Succeed())
+		Expect(r.Record("worker", "kubernetes", nil)).To(Succeed())
+		Expect(ledger.puts).To(Equal(3))
+
+		list, err := List(client, "kairos", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(list).To(HaveLen(3))
+		Expect(list[0].Step).To(Equal("vpn"))
+		Expect(list[1].Outcome).To(Equal(OutcomeFailure))
+		Expect(list[1].Error).To(Equal("no master yet"))
+		Expect(list[2].Outcome).To(Equal(OutcomeSuccess))
+	})
+
+	It("keeps the last events of each node and the history across restarts", func() {
+		defer func(m int) { MaxEvents = m }(MaxEvents)
+		MaxEvents = 2
+
+		r := NewRecorder(client, "kairos", "node-a")
+		Expect(r.Record("", "vpn", nil)).To(Succeed())
+		Expect(r.Record("", "networks", nil)).To(Succeed())
+
+		r = NewRecorder(client, "kairos", "node-a")
+		Expect(r.Record("", "api", nil)).To(Succeed())
+		Expect(NewRecorder(client, "kairos", "node-b").Record("", "vpn", nil)).To(Succeed())
+
+		list, err := List(client, "kairos", "node-a")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(list).To(HaveLen(2))
+		Expect(list[0].Step).To(Equal("networks"))
+		Expect(list[1].Step).To(Equal("api"))
+
+		list, err = List(client, "kairos", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(list).To(HaveLen(3))
+	})
+
+	It("keeps events until the API is reachable", func() {
+		ledger.down = true
+		r := NewRecorder(client, "kairos", "node-a")
+		Expect(r.Record("", "vpn", nil)).ToNot(Succeed())
+
+		ledger.down = false
+		Expect(r.Record("", "networks", nil)).To(Succeed())
+		list, err := List(client, "kairos", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(list).To(HaveLen(2))
+	})
+})
@@ -0,0 +1,179 @@
+package metrics
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/mudler/edgevpn/api/client/service"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "kairos_provider"
+
+var (
+	Registry = prometheus.NewRegistry()
+
+	advertizingNodes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "p2p_advertizing_nodes",
+		Help:      "Number of nodes advertizing on the network.",
+	})
+	activeNodes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "p2p_active_nodes",
+		Help:      "Number of active nodes on the network.",
+	})
+	leader = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "p2p_leader",
+		Help:      "Current auto leader, set to 1 for its UUID.",
+	}, []string{"uuid"})
+	isLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "p2p_is_leader",
+		Help:      "Whether this node is the current auto leader.",
+	})
+	roles = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "role_assignment",
+		Help:      "Role assigned to each advertizing node, set to 1.",
+	}, []string{"uuid", "role"})
+	stepStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "bootstrap_step_success",
+		Help:      "Whether the last run of a bootstrap step succeeded.",
+	}, []string{"step"})
+	stepWaiting = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "bootstrap_step_waiting",
+		Help:      "Whether a bootstrap step ran without errors, but is still waiting to complete.",
+	}, []string{"step"})
+	stepDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "bootstrap_step_duration_seconds",
+		Help:      "Duration of the last run of a bootstrap step.",
+	}, []string{"step"})
+	kubernetesConfigured = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "kubernetes_configured",
+		Help:      "Whether Kubernetes has been configured on this node.",
+	})
+	ledgerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ledger_errors_total",
+		Help:      "Number of failed ledger operations.",
+	}, []string{"operation"})
+	vpnUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "vpn_interface_up",
+		Help:      "Whether the VPN interface exists, is up and has an address.",
+	}, []string{"interface"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		advertizingNodes, activeNodes, leader, isLeader, roles,
+		stepStatus, stepWaiting, stepDuration, kubernetesConfigured, ledgerErrors, vpnUp,
+	)
+}
+
+// Serve exposes the metrics in Prometheus text format on /metrics.
+func Serve(listen string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+	server := &http.Server{Addr: listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	return server.ListenAndServe()
+}
+
+// LedgerError records a failed ledger operation.
+func LedgerError(operation string) {
+	ledgerErrors.WithLabelValues(operation).Inc()
+}
+
+// Step runs a bootstrap step recording its status and duration.
+func Step(name string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	recordStep(name, start, err == nil, false)
+	return err
+}
+
+// Role wraps a node role, recording each run as a bootstrap step. Roles return no error
+// while they wait for other nodes, so the step succeeds only once done reports it
+// completed, and is reported as waiting until then.
+func Role(name string, done func() bool, r func(*service.RoleConfig) error) func(*service.RoleConfig) error {
+	return func(c *service.RoleConfig) error {
+		start := time.Now()
+		err := r(c)
+		completed := err == nil && done()
+		recordStep(name, start, completed, err == nil && !completed)
+		return err
+	}
+}
+
+func recordStep(name string, start time.Time, succeeded, waiting bool) {
+	stepDuration.WithLabelValues(name).Set(time.Since(start).Seconds())
+	stepStatus.WithLabelValues(name).Set(boolValue(succeeded))
+	stepWaiting.WithLabelValues(name).Set(boolValue(waiting))
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func interfaceUp(name string) bool {
+	i, err := net.InterfaceByName(name)
+	if err != nil || i.Flags&net.FlagUp == 0 {
+		return false
+	}
+	addrs, err := i.Addrs()
+	return err == nil && len(addrs) > 0
+}
+
+// Collector refreshes the mesh state gauges on every iteration of the node loop.
+func Collector(vpnInterface string, configured func() bool) func(*service.RoleConfig) error {
+	return func(c *service.RoleConfig) error {
+		advertizing, err := c.Client.AdvertizingNodes()
+		if err != nil {
+			LedgerError("advertizing_nodes")
+		}
+		advertizingNodes.Set(float64(len(advertizing)))
+
+		actives, err := c.Client.ActiveNodes()
+		if err != nil {
+			LedgerError("active_nodes")
+		}
+		activeNodes.Set(float64(len(actives)))
+
+		lead, err := c.Client.Get("auto", "leader")
+		if err != nil {
+			LedgerError("get")
+		}
+		leader.Reset()
+		if lead != "" {
+			leader.WithLabelValues(lead).Set(1)
+		}
+		isLeader.Set(boolValue(lead == c.UUID))
+
+		roles.Reset()
+		for _, n := range advertizing {
+			if r, _ := c.Client.Get("role", n); r != "" {
+				roles.WithLabelValues(n, r).Set(1)
+			}
+		}
+
+		kubernetesConfigured.Set(boolValue(configured()))
+		if vpnInterface != "" {
+			vpnUp.WithLabelValues(vpnInterface).Set(boolValue(interfaceUp(vpnInterface)))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,61 @@
+package metrics_test
+
+import (
+	"errors"
+	"strings"
+
+	. "github.com/kairos-io/provider-kairos/v2/internal/metrics"
+	"github.com/mudler/edgevpn/api/client/service"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Metrics", func() {
+	It("records the status of bootstrap steps", func() {
+		Expect(Step("vpn", func() error { return nil })).To(Succeed())
+
+		worker := Role("worker", func() bool { return false }, func(*service.RoleConfig) error { return errors.New("no master yet") })
+		Expect(worker(&service.RoleConfig{})).ToNot(Succeed())
+
+		configured := false
+		master := Role("master", func() bool { return configured }, func(*service.RoleConfig) error { return nil })
+		Expect(master(&service.RoleConfig{})).To(Succeed())
+
+		Expect(testutil.GatherAndCompare(Registry, strings.NewReader(`
+# HELP kairos_provider_bootstrap_step_success Whether the last run of a bootstrap step succeeded.
+# TYPE kairos_provider_bootstrap_step_success gauge
+kairos_provider_bootstrap_step_success{step="master"} 0
+kairos_provider_bootstrap_step_success{step="vpn"} 1
+kairos_provider_bootstrap_step_success{step="worker"} 0
+# HELP kairos_provider_bootstrap_step_waiting Whether a bootstrap step ran without errors, but is still waiting to complete.
+# TYPE kairos_provider_bootstrap_step_waiting gauge
+kairos_provider_bootstrap_step_waiting{step="master"} 1
+kairos_provider_bootstrap_step_waiting{step="vpn"} 0
+kairos_provider_bootstrap_step_waiting{step="worker"} 0
+`), "kairos_provider_bootstrap_step_success", "kairos_provider_bootstrap_step_waiting")).To(Succeed())
+
+		configured = true
+		Expect(master(&service.RoleConfig{})).To(Succeed())
+		Expect(testutil.GatherAndCompare(Registry, strings.NewReader(`
+# HELP kairos_provider_bootstrap_step_success Whether the last run of a bootstrap step succeeded.
+# TYPE kairos_provider_bootstrap_step_success gauge
+kairos_provider_bootstrap_step_success{step="master"} 1
+kairos_provider_bootstrap_step_success{step="vpn"} 1
+kairos_provider_bootstrap_step_success{step="worker"} 0
+`), "kairos_provider_bootstrap_step_success")).To(Succeed())
+	})
+
+	It("counts ledger errors by operation", func() {
+		LedgerError("set")
+		LedgerError("set")
+		LedgerError("delete")
+
+		Expect(testutil.GatherAndCompare(Registry, strings.NewReader(`
+# HELP kairos_provider_ledger_errors_total Number of failed ledger operations.
+# TYPE kairos_provider_ledger_errors_total counter
+kairos_provider_ledger_errors_total{operation="delete"} 1
+kairos_provider_ledger_errors_total{operation="set"} 2
+`), "kairos_provider_ledger_errors_total")).To(Succeed())
+	})
+})
@@ -0,0 +1,67 @@
+// Package operator handles the keys operators sign their decisions with, such as
+// the admission of nodes. Nodes only follow decisions signed with a trusted key.
+package operator
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// GenerateKey returns a new operator key, as a PEM private key and its base64 public key.
+func GenerateKey() ([]byte, string, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	dat, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, "", err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: dat}), base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// ParseKey reads a PEM operator key.
+func ParseKey(dat []byte) (ed25519.PrivateKey, error) {
+	b, _ := pem.Decode(dat)
+	if b == nil {
+		return nil, errors.New("invalid operator key: no PEM data")
+	}
+	k, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid operator key: %w", err)
+	}
+	priv, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("invalid operator key: an ed25519 key is required")
+	}
+	return priv, nil
+}
+
+// ReadKey reads the operator key written by operator-key generate.
+func ReadKey(path string) (ed25519.PrivateKey, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKey(dat)
+}
+
+// PublicKey returns the base64 public key of an operator key, as listed in the trusted keys.
+func PublicKey(k ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(k.Public().(ed25519.PublicKey))
+}
+
+// ParsePublicKey reads a base64 operator public key.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	dat, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(dat) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid operator public key '%s', a base64 ed25519 public key is required", s)
+	}
+	return ed25519.PublicKey(dat), nil
+}
@@ -0,0 +1,30 @@
+package operator_test
+
+import (
+	"github.com/kairos-io/provider-kairos/v2/internal/operator"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Operator keys", func() {
+	It("reads back a generated key", func() {
+		priv, pub, err := operator.GenerateKey()
+		Expect(err).ToNot(HaveOccurred())
+
+		key, err := operator.ParseKey(priv)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(operator.PublicKey(key)).To(Equal(pub))
+
+		public, err := operator.ParsePublicKey(pub)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(public.Equal(key.Public())).To(BeTrue())
+	})
+
+	It("rejects invalid keys", func() {
+		_, err := operator.ParseKey([]byte("garbage"))
+		Expect(err).To(HaveOccurred())
+		_, err = operator.ParsePublicKey("garbage")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,318 @@
+// Package pairing implements the two-way pairing flow: on top of the payload sent
+// by go-nodepair, the node replies whether it accepts it and reports the install progress.
+// The ledger keys are compatible with go-nodepair, so either side can run an older version.
+package pairing
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-log/v2"
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/config"
+	"github.com/mudler/edgevpn/pkg/logger"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/services"
+)
+
+const (
+	bucket      = "pairing"
+	dataKey     = "data"
+	resultKey   = "result"
+	progressKey = "progress"
+	presence    = "presence"
+	// The node announcements are in their own buckets, as any key of the
+	// pairing one acknowledges the payload
+	factsBucket = "pairing-facts"
+	keysBucket  = "pairing-keys"
+	// targetKey of a payload is the peer ID of the only node which may take it
+	targetKey = "target"
+
+	announceInterval = 2 * time.Second
+	pollInterval     = time.Second
+)
+
+// Result is the reply of the node to the payload.
+type Result struct {
+	Accepted bool     `json:"accepted"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// Channel is a pairing node, announcing values to the peers sharing its token.
+type Channel struct {
+	sync.Mutex
+
+	ctx     context.Context
+	node    *node.Node
+	ledger  *blockchain.Ledger
+	cancel  map[string]context.CancelFunc
+	keyHash string
+}
+
+// newNode mirrors the go-nodepair node settings.
+func newNode(token, loglevel string) (*node.Node, error) {
+	defaultInterval := 10 * time.Second
+	if loglevel == "" {
+		loglevel = "fatal"
+	}
+	lvl, err := log.LevelFromString(loglevel)
+	if err != nil {
+		lvl = log.LevelFatal
+	}
+
+	c := config.Config{
+		Limit: config.ResourceLimit{
+			Enable:   true,
+			MaxConns: 100,
+		},
+		NetworkToken:   token,
+		LogLevel:       loglevel,
+		Libp2pLogLevel: "fatal",
+		Ledger: config.Ledger{
+			SyncInterval:     defaultInterval,
+			AnnounceInterval: defaultInterval,
+		},
+		NAT: config.NAT{
+			Service:           true,
+			Map:               true,
+			RateLimit:         true,
+			RateLimitGlobal:   10,
+			RateLimitPeer:     10,
+			RateLimitInterval: defaultInterval,
+		},
+		Discovery: config.Discovery{
+			DHT:      true,
+			MDNS:     true,
+			Interval: 30 * time.Second,
+		},
+		Connection: config.Connection{
+			HolePunch:      true,
+			AutoRelay:      true,
+			MaxConnections: 100,
+		},
+	}
+
+	o, _, err := c.ToOpts(logger.New(lvl))
+	if err != nil {
+		return nil, fmt.Errorf("parsing options: %w", err)
+	}
+	o = append(o, services.Alive(30*time.Second, 900*time.Second, 15*time.Minute)...)
+
+	return node.New(o...)
+}
+
+// Open joins the pairing network of the token until ctx is done.
+// The token can have a node key bound with BindKey.
+func Open(ctx context.Context, token, loglevel string) (*Channel, error) {
+	token, hash := splitToken(token)
+	if token == "" {
+		return nil, errors.New("no token supplied or couldn't read from providers (try with a better image or input source)")
+	}
+	n, err := newNode(token, loglevel)
+	if err != nil {
+		return nil, fmt.Errorf("creating a new node: %w", err)
+	}
+	if err := n.Start(ctx); err != nil {
+		return nil, err
+	}
+	l, err := n.Ledger()
+	if err != nil {
+		return nil, err
+	}
+
+	ch := &Channel{ctx: ctx, node: n, ledger: l, cancel: map[string]context.CancelFunc{}, keyHash: hash}
+	ch.announce(presence, ch.ID(), "")
+	return ch, nil
+}
+
+// KeyHash is the hash of the node key bound to the pairing token, if any.
+func (c *Channel) KeyHash() string {
+	return c.keyHash
+}
+
+// ID is the peer ID of the channel node.
+func (c *Channel) ID() string {
+	return c.node.Host().ID().String()
+}
+
+// announce keeps announcing the latest value of the key.
+func (c *Channel) announce(b, key string, value interface{}) {
+	c.Lock()
+	defer c.Unlock()
+
+	id := b + "/" + key
+	if cancel, ok := c.cancel[id]; ok {
+		cancel()
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.cancel[id] = cancel
+	c.ledger.AnnounceUpdate(ctx, announceInterval, b, key, value)
+}
+
+func (c *Channel) get(key string, v interface{}) bool {
+	d, exists := c.ledger.GetKey(bucket, key)
+	if !exists {
+		return false
+	}
+	return d.Unmarshal(v) == nil
+}
+
+// poll calls f until it returns true or ctx is done.
+func poll(ctx context.Context, f func() bool) error {
+	for !f() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+	return nil
+}
+
+// Send announces the payload and waits for a node to acknowledge it. With a peer ID,
+// the payload is only taken by the node of that peer, and only its acknowledgement counts.
+// Older nodes don't know about the target, and take any payload.
+func (c *Channel) Send(ctx context.Context, payload map[string]string, peer string) error {
+	if peer != "" {
+		targeted := map[string]string{targetKey: peer}
+		for k, v := range payload {
+			targeted[k] = v
+		}
+		payload = targeted
+	}
+	c.announce(bucket, dataKey, payload)
+	return poll(ctx, func() bool {
+		for k := range c.ledger.CurrentData()[bucket] {
+			switch k {
+			case dataKey, resultKey, progressKey, c.ID():
+			default:
+				if peer == "" || k == peer {
+					return true
+				}
+			}
+		}
+		return false
+	})
+}
+
+// Receive waits for a payload addressed to the node, or to any node, and acknowledges it.
+func (c *Channel) Receive(ctx context.Context, payload *map[string]string) error {
+	err := poll(ctx, func() bool {
+		p := map[string]string{}
+		if !c.get(dataKey, &p) {
+			return false
+		}
+		if target, ok := p[targetKey]; ok && target != c.ID() {
+			return false
+		}
+		delete(p, targetKey)
+		*payload = p
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	c.announce(bucket, c.ID(), "ok")
+	return nil
+}
+
+// Reply announces whether the payload was accepted.
+func (c *Channel) Reply(r Result) {
+	c.announce(bucket, resultKey, r)
+}
+
+// Report announces the install progress.
+func (c *Channel) Report(p []Progress) {
+	c.announce(bucket, progressKey, p)
+}
+
+// ReportFacts announces the facts of the machine.
+func (c *Channel) ReportFacts(f Facts) {
+	c.announce(factsBucket, c.ID(), f)
+}
+
+// Facts waits for the facts of a node, returning its peer ID with them. Any peer sharing
+// the token can report facts: the payload rendered with them has to be sent to that peer.
+func (c *Channel) Facts(ctx context.Context) (string, Facts, error) {
+	f := Facts{}
+	peer := ""
+	err := poll(ctx, func() bool {
+		for k, d := range c.ledger.CurrentData()[factsBucket] {
+			if d.Unmarshal(&f) == nil {
+				peer = k
+				return true
+			}
+		}
+		return false
+	})
+	return peer, f, err
+}
+
+// ReportKey announces the key the payload can be encrypted to.
+func (c *Channel) ReportKey(k *NodeKey) {
+	c.announce(keysBucket, c.ID(), base64.StdEncoding.EncodeToString(k.Public[:]))
+}
+
+// NodeKey waits for the key of the node bound to the pairing token. Any peer sharing
+// the token can report a key, only the one matching the hash shown on the node screen is used.
+func (c *Channel) NodeKey(ctx context.Context) (*[32]byte, error) {
+	if c.keyHash == "" {
+		return nil, errors.New("the pairing token has no node key bound, the node needs pairing.trusted_keys to bind one")
+	}
+	key := &[32]byte{}
+	err := poll(ctx, func() bool {
+		for _, d := range c.ledger.CurrentData()[keysBucket] {
+			s := ""
+			if d.Unmarshal(&s) != nil {
+				continue
+			}
+			if dat, err := base64.StdEncoding.DecodeString(s); err == nil && len(dat) == len(key) {
+				copy(key[:], dat)
+				if keyHash(key) == c.keyHash {
+					return true
+				}
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return nil, fmt.Errorf("the node didn't report the key bound to the pairing token: %w", err)
+	}
+	return key, nil
+}
+
+// Result waits for the reply of the node.
+func (c *Channel) Result(ctx context.Context) (Result, error) {
+	r := Result{}
+	err := poll(ctx, func() bool { return c.get(resultKey, &r) })
+	return r, err
+}
+
+// Watch calls f with each new progress step until the install is over,
+// returning an error if it failed.
+func (c *Channel) Watch(ctx context.Context, f func(Progress)) error {
+	seen := 0
+	var last *Progress
+	err := poll(ctx, func() bool {
+		p := []Progress{}
+		if !c.get(progressKey, &p) {
+			return false
+		}
+		for ; seen < len(p); seen++ {
+			last = &p[seen]
+			f(*last)
+		}
+		return last != nil && (last.Done || last.Error != "")
+	})
+	if err != nil {
+		return err
+	}
+	if last.Error != "" {
+		return fmt.Errorf("installation failed while %s: %s", last.Stage, last.Error)
+	}
+	return nil
+}
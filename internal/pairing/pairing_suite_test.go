@@ -0,0 +1,13 @@
+package pairing
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestPairing(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Pairing Suite")
+}
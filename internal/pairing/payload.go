@@ -0,0 +1,73 @@
+package pairing
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
+	"gopkg.in/yaml.v3"
+)
+
+// dmiDir exposes the machine identifiers.
+var dmiDir = "/sys/class/dmi/id"
+
+// Facts describe the machine of a node, as reported by the node itself, so that the
+// operator can render its config.
+type Facts struct {
+	UUID   string   `json:"uuid,omitempty"`
+	Serial string   `json:"serial,omitempty"`
+	MAC    string   `json:"mac,omitempty"`
+	MACs   []string `json:"macs,omitempty"`
+}
+
+// LocalFacts returns the facts of the machine. The MAC is the one of the first interface by name.
+func LocalFacts() Facts {
+	read := func(name string) string {
+		dat, _ := os.ReadFile(fmt.Sprintf("%s/%s", dmiDir, name))
+		return strings.TrimSpace(string(dat))
+	}
+	f := Facts{UUID: read("product_uuid"), Serial: read("product_serial")}
+
+	ifaces, _ := net.Interfaces()
+	sort.Slice(ifaces, func(i, j int) bool { return ifaces[i].Name < ifaces[j].Name })
+	for _, i := range ifaces {
+		if i.Flags&net.FlagLoopback != 0 || len(i.HardwareAddr) == 0 {
+			continue
+		}
+		f.MACs = append(f.MACs, i.HardwareAddr.String())
+	}
+	if len(f.MACs) > 0 {
+		f.MAC = f.MACs[0]
+	}
+	return f
+}
+
+// ValidatePayload returns the problems of a pairing payload, which make the node reject it.
+func ValidatePayload(r map[string]string) []string {
+	errs := []string{}
+	if strings.TrimSpace(r["cc"]) == "" {
+		return append(errs, "the configuration is empty")
+	}
+
+	c := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(r["cc"]), &c); err != nil {
+		return append(errs, fmt.Sprintf("the configuration is not valid YAML: %s", err.Error()))
+	}
+
+	cfg := &providerConfig.Config{}
+	if err := yaml.Unmarshal([]byte(r["cc"]), cfg); err != nil {
+		errs = append(errs, err.Error())
+	} else if err := cfg.Validate(); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	_, reboot := r["reboot"]
+	_, poweroff := r["poweroff"]
+	if reboot && poweroff {
+		errs = append(errs, "reboot and poweroff can't be both set")
+	}
+	return errs
+}
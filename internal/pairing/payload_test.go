@@ -0,0 +1,53 @@
+package pairing
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Payload", func() {
+	Context("ValidatePayload", func() {
+		It("accepts a valid configuration", func() {
+			Expect(ValidatePayload(map[string]string{
+				"cc":     "#cloud-config\np2p:\n  role: worker\n",
+				"reboot": "",
+			})).To(BeEmpty())
+		})
+
+		It("rejects empty and malformed configurations", func() {
+			Expect(ValidatePayload(map[string]string{"cc": " "})).To(Equal([]string{"the configuration is empty"}))
+			errs := ValidatePayload(map[string]string{"cc": "p2p: ["})
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[0]).To(HavePrefix("the configuration is not valid YAML"))
+		})
+
+		It("reports the provider config and options errors", func() {
+			errs := ValidatePayload(map[string]string{
+				"cc":       "p2p:\n  role: foo\n",
+				"reboot":   "",
+				"poweroff": "",
+			})
+			Expect(errs).To(HaveLen(2))
+			Expect(errs[0]).To(ContainSubstring("invalid p2p.role 'foo'"))
+			Expect(errs[1]).To(Equal("reboot and poweroff can't be both set"))
+		})
+	})
+
+	It("reads the machine identifiers", func() {
+		dir := GinkgoT().TempDir()
+		Expect(os.WriteFile(filepath.Join(dir, "product_uuid"), []byte("4c4c4544-0042\n"), 0600)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "product_serial"), []byte("ABC123\n"), 0600)).To(Succeed())
+		DeferCleanup(func(d string) { dmiDir = d }, dmiDir)
+		dmiDir = dir
+
+		f := LocalFacts()
+		Expect(f.UUID).To(Equal("4c4c4544-0042"))
+		Expect(f.Serial).To(Equal("ABC123"))
+		if len(f.MACs) > 0 {
+			Expect(f.MAC).To(Equal(f.MACs[0]))
+		}
+	})
+})
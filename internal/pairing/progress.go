@@ -0,0 +1,203 @@
+package pairing
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	StagePartitioning = "partitioning"
+	StageCopying      = "copying"
+	StageFinalizing   = "finalizing"
+	StageRebooting    = "rebooting"
+	StagePoweringOff  = "powering off"
+	StageDone         = "done"
+)
+
+const (
+	resultFile   = "result.json"
+	progressFile = "progress"
+	sentFile     = "sent"
+)
+
+// Grace is how long the relay keeps announcing once the install is over,
+// so that the operator gets the last values.
+var Grace = 30 * time.Second
+
+// Progress is an install step of the node.
+type Progress struct {
+	Time  time.Time `json:"time"`
+	Stage string    `json:"stage"`
+	Error string    `json:"error,omitempty"`
+	Done  bool      `json:"done,omitempty"`
+}
+
+// installStages are the agent stages reporting the progress, in order.
+var installStages = []struct{ stage, progress string }{
+	{"kairos-install.pre", StagePartitioning},
+	{"before-install", StageCopying},
+	{"after-install", StageFinalizing},
+	{"kairos-install.after", ""},
+}
+
+// FinalStage returns the last stage reported for the payload options.
+func FinalStage(reboot, poweroff bool) string {
+	switch {
+	case poweroff:
+		return StagePoweringOff
+	case reboot:
+		return StageRebooting
+	default:
+		return StageDone
+	}
+}
+
+func isFinal(stage string) bool {
+	return stage == StageRebooting || stage == StagePoweringOff || stage == StageDone
+}
+
+// WriteHookStages writes to path the stages appending the progress in dir.
+// They are kept out of the payload configuration, which the agent installs as is,
+// so that the node doesn't carry them after the install.
+func WriteHookStages(path, dir, final string) error {
+	stages := map[string]interface{}{}
+	progressPath := filepath.Join(dir, progressFile)
+	for _, s := range installStages {
+		progress := s.progress
+		if progress == "" {
+			progress = final
+		}
+		commands := []string{fmt.Sprintf("echo '%s' >> %s", progress, progressPath)}
+		if s.progress == "" {
+			// Give the relay time to announce it before the node goes down
+			commands = append(commands, fmt.Sprintf("for i in $(seq 1 20); do [ -e %s ] && break; sleep 1; done", filepath.Join(dir, sentFile)))
+		}
+
+		stages[s.stage] = []interface{}{map[string]interface{}{
+			"name":     fmt.Sprintf("Report %s to the pairing operator", progress),
+			"commands": commands,
+		}}
+	}
+
+	y, err := yaml.Marshal(map[string]interface{}{"stages": stages})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, y, 0600)
+}
+
+// WriteResult stores the result in dir for the relay.
+func WriteResult(dir string, r Result) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	dat, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, resultFile), dat, 0600)
+}
+
+// Reset removes the progress of a previous install from dir.
+func Reset(dir string) {
+	os.Remove(filepath.Join(dir, progressFile)) //nolint:errcheck
+	os.Remove(filepath.Join(dir, sentFile))     //nolint:errcheck
+}
+
+func readResult(dir string) (Result, error) {
+	r := Result{}
+	dat, err := os.ReadFile(filepath.Join(dir, resultFile))
+	if err != nil {
+		return r, err
+	}
+	return r, json.Unmarshal(dat, &r)
+}
+
+// readStages returns the stages appended to the progress file of dir.
+func readStages(dir string) []string {
+	f, err := os.Open(filepath.Join(dir, progressFile))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	stages := []string{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			stages = append(stages, line)
+		}
+	}
+	return stages
+}
+
+// Relay announces the result and the progress stored in dir while the agent process runs.
+// It reports a failure if the agent exits before the final stage.
+func (c *Channel) Relay(ctx context.Context, dir string, agentRunning func() bool) error {
+	r, err := readResult(dir)
+	if err != nil {
+		return err
+	}
+	c.Reply(r)
+	if !r.Accepted {
+		return sleep(ctx, Grace)
+	}
+
+	progress := []Progress{}
+	for {
+		for i, s := range readStages(dir) {
+			if i >= len(progress) {
+				progress = append(progress, Progress{Time: time.Now().UTC(), Stage: s, Done: isFinal(s)})
+			}
+		}
+		c.Report(progress)
+
+		if n := len(progress); n > 0 && progress[n-1].Done {
+			// Announcing is asynchronous, leave it a few rounds before the hook carries on
+			if err := sleep(ctx, 3*announceInterval); err != nil {
+				return err
+			}
+			if err := os.WriteFile(filepath.Join(dir, sentFile), []byte{}, 0600); err != nil {
+				return err
+			}
+			return sleep(ctx, Grace)
+		}
+
+		if !agentRunning() {
+			stage := "starting"
+			if n := len(progress); n > 0 {
+				stage = progress[n-1].Stage
+			}
+			c.Report(append(progress, Progress{
+				Time:  time.Now().UTC(),
+				Stage: stage,
+				Error: "the installer exited, see the kairos-agent logs on the node",
+			}))
+			return sleep(ctx, Grace)
+		}
+
+		if err := sleep(ctx, pollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
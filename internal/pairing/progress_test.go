@@ -0,0 +1,55 @@
+package pairing
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gopkg.in/yaml.v3"
+)
+
+var _ = Describe("Install progress", func() {
+	It("writes the progress hooks apart from the configuration", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "oem", "pairing.yaml")
+		Expect(WriteHookStages(path, "/run/pairing", StageRebooting)).To(Succeed())
+		info, err := os.Stat(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+
+		dat, err := os.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		c := struct {
+			Stages map[string][]struct {
+				Name     string   `yaml:"name"`
+				Commands []string `yaml:"commands"`
+			} `yaml:"stages"`
+		}{}
+		Expect(yaml.Unmarshal(dat, &c)).To(Succeed())
+		Expect(c.Stages).To(HaveLen(4))
+		Expect(c.Stages["kairos-install.pre"][0].Commands).To(Equal([]string{"echo 'partitioning' >> /run/pairing/progress"}))
+		Expect(c.Stages["kairos-install.after"][0].Commands).To(HaveLen(2))
+		Expect(c.Stages["kairos-install.after"][0].Commands[0]).To(Equal("echo 'rebooting' >> /run/pairing/progress"))
+	})
+
+	It("picks the final stage from the payload options", func() {
+		Expect(FinalStage(false, false)).To(Equal(StageDone))
+		Expect(FinalStage(true, false)).To(Equal(StageRebooting))
+		Expect(FinalStage(false, true)).To(Equal(StagePoweringOff))
+	})
+
+	It("reads back the result and the progress", func() {
+		dir := filepath.Join(GinkgoT().TempDir(), "pairing")
+		Expect(WriteResult(dir, Result{Errors: []string{"bad"}})).To(Succeed())
+		r, err := readResult(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(r).To(Equal(Result{Errors: []string{"bad"}}))
+
+		Expect(readStages(dir)).To(BeEmpty())
+		Expect(os.WriteFile(filepath.Join(dir, progressFile), []byte("partitioning\n\ncopying\n"), 0600)).To(Succeed())
+		Expect(readStages(dir)).To(Equal([]string{StagePartitioning, StageCopying}))
+
+		Reset(dir)
+		Expect(readStages(dir)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,204 @@
+package pairing
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/provider-kairos/v2/internal/operator"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Envelope fields of a signed payload. A payload without signatureField is a plain one.
+const (
+	payloadField   = "payload"
+	signatureField = "signature"
+	keyField       = "key"
+	encryptedField = "encrypted"
+)
+
+// keySeparator separates the pairing token from the hash of the node key bound to it.
+// Network tokens are base64, so they never contain it.
+const keySeparator = "#"
+
+// nodeKeyFile stores the node key between the challenge and the install.
+const nodeKeyFile = "node.key"
+
+// NodeKey is the one-time key of a pairing. Its hash is bound to the token shown on
+// the node screen: payloads are signed for it, and encrypted to it.
+type NodeKey struct {
+	Public, Private *[32]byte
+}
+
+// NewNodeKey generates the key of a pairing.
+func NewNodeKey() (*NodeKey, error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &NodeKey{Public: pub, Private: priv}, nil
+}
+
+// WriteNodeKey stores the node key in dir for the install.
+func WriteNodeKey(dir string, k *NodeKey) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, nodeKeyFile), append(k.Public[:], k.Private[:]...), 0600)
+}
+
+// ReadNodeKey reads the node key stored in dir.
+func ReadNodeKey(dir string) (*NodeKey, error) {
+	dat, err := os.ReadFile(filepath.Join(dir, nodeKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	if len(dat) != 64 {
+		return nil, errors.New("invalid node key")
+	}
+	k := &NodeKey{Public: &[32]byte{}, Private: &[32]byte{}}
+	copy(k.Public[:], dat[:32])
+	copy(k.Private[:], dat[32:])
+	return k, nil
+}
+
+func keyHash(pub *[32]byte) string {
+	h := sha256.Sum256(pub[:])
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// BindKey appends the hash of the node key to the pairing token shown on the node
+// screen, so that the operator scanning it signs and encrypts payloads for that node only.
+func BindKey(token string, k *NodeKey) string {
+	return token + keySeparator + keyHash(k.Public)
+}
+
+// splitToken returns the network token and the hash of the key bound to the pairing token, if any.
+func splitToken(token string) (string, string) {
+	network, hash, _ := strings.Cut(token, keySeparator)
+	return network, hash
+}
+
+// signedMessage binds the payload to the node key. Nodes built from the same image share
+// their network token, but each one generates its own key, so a payload can't be replayed
+// to another node.
+func signedMessage(nodeKeyHash, payload string) []byte {
+	return []byte(fmt.Sprintf("kairos-pairing-v1\n%s\n%s", nodeKeyHash, payload))
+}
+
+// PayloadPolicy are the requirements of the node on the payloads.
+type PayloadPolicy struct {
+	TrustedKeys       []string
+	RequireEncryption bool
+}
+
+// NeedsNodeKey tells whether the node binds a key to its pairing token.
+func (p PayloadPolicy) NeedsNodeKey() bool {
+	return len(p.TrustedKeys) > 0 || p.RequireEncryption
+}
+
+// SealPayload wraps the payload in an envelope signed with key for the node key hash, if
+// set, and encrypted to nodeKey, if set.
+func SealPayload(payload map[string]string, nodeKeyHash string, key ed25519.PrivateKey, nodeKey *[32]byte) (map[string]string, error) {
+	if key != nil && nodeKeyHash == "" {
+		return nil, errors.New("the pairing token has no node key bound, the node needs pairing.trusted_keys to bind one")
+	}
+	dat, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	envelope := map[string]string{}
+	if nodeKey != nil {
+		if dat, err = box.SealAnonymous(nil, dat, nodeKey, rand.Reader); err != nil {
+			return nil, err
+		}
+		envelope[encryptedField] = "true"
+	}
+	envelope[payloadField] = base64.StdEncoding.EncodeToString(dat)
+
+	envelope[signatureField] = ""
+	if key != nil {
+		sig := ed25519.Sign(key, signedMessage(nodeKeyHash, envelope[payloadField]))
+		envelope[signatureField] = base64.StdEncoding.EncodeToString(sig)
+		envelope[keyField] = operator.PublicKey(key)
+	}
+	return envelope, nil
+}
+
+// OpenPayload returns the payload of an envelope. With trusted keys, only payloads signed
+// by one of them for the node key are accepted. Plain payloads are returned as they are when allowed.
+func OpenPayload(envelope map[string]string, policy PayloadPolicy, nodeKey *NodeKey) (map[string]string, error) {
+	sig, signed := envelope[signatureField]
+	if !signed {
+		switch {
+		case len(policy.TrustedKeys) > 0:
+			return nil, errors.New("the payload is not signed, a signature from a trusted key is required")
+		case policy.RequireEncryption:
+			return nil, errors.New("the payload is not encrypted, encryption is required")
+		}
+		return envelope, nil
+	}
+
+	if len(policy.TrustedKeys) > 0 {
+		if sig == "" {
+			return nil, errors.New("the payload is not signed, a signature from a trusted key is required")
+		}
+		if nodeKey == nil {
+			return nil, errors.New("the payload is signed, but the node has no key")
+		}
+		if err := verify(envelope, keyHash(nodeKey.Public), policy.TrustedKeys); err != nil {
+			return nil, err
+		}
+	}
+
+	dat, err := base64.StdEncoding.DecodeString(envelope[payloadField])
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload: %w", err)
+	}
+	if envelope[encryptedField] == "true" {
+		if nodeKey == nil {
+			return nil, errors.New("the payload is encrypted, but the node has no key")
+		}
+		var ok bool
+		if dat, ok = box.OpenAnonymous(nil, dat, nodeKey.Public, nodeKey.Private); !ok {
+			return nil, errors.New("the payload could not be decrypted with the node key")
+		}
+	} else if policy.RequireEncryption {
+		return nil, errors.New("the payload is not encrypted, encryption is required")
+	}
+
+	payload := map[string]string{}
+	if err := json.Unmarshal(dat, &payload); err != nil {
+		return nil, fmt.Errorf("invalid payload: %w", err)
+	}
+	return payload, nil
+}
+
+func verify(envelope map[string]string, nodeKeyHash string, trusted []string) error {
+	sig, err := base64.StdEncoding.DecodeString(envelope[signatureField])
+	if err != nil {
+		return errors.New("invalid payload signature")
+	}
+	trustedKey := false
+	for _, t := range trusted {
+		trustedKey = trustedKey || t == envelope[keyField]
+	}
+	if !trustedKey {
+		return fmt.Errorf("the payload is signed with the untrusted key '%s'", envelope[keyField])
+	}
+	pub, err := operator.ParsePublicKey(envelope[keyField])
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, signedMessage(nodeKeyHash, envelope[payloadField]), sig) {
+		return errors.New("invalid payload signature")
+	}
+	return nil
+}
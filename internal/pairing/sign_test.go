@@ -0,0 +1,100 @@
+package pairing
+
+import (
+	"crypto/ed25519"
+
+	"github.com/kairos-io/provider-kairos/v2/internal/operator"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Signed payloads", func() {
+	payload := map[string]string{"cc": "#cloud-config\n", "device": "/dev/sda"}
+	var key ed25519.PrivateKey
+	var pub string
+	var nodeKey *NodeKey
+	var bound string
+
+	BeforeEach(func() {
+		pem, p, err := operator.GenerateKey()
+		Expect(err).ToNot(HaveOccurred())
+		key, err = operator.ParseKey(pem)
+		Expect(err).ToNot(HaveOccurred())
+		pub = p
+		nodeKey, err = NewNodeKey()
+		Expect(err).ToNot(HaveOccurred())
+		_, bound = splitToken(BindKey("token", nodeKey))
+	})
+
+	It("accepts plain payloads unless required otherwise", func() {
+		Expect(OpenPayload(payload, PayloadPolicy{}, nodeKey)).To(Equal(payload))
+		_, err := OpenPayload(payload, PayloadPolicy{TrustedKeys: []string{pub}}, nodeKey)
+		Expect(err).To(MatchError("the payload is not signed, a signature from a trusted key is required"))
+		_, err = OpenPayload(payload, PayloadPolicy{RequireEncryption: true}, nodeKey)
+		Expect(err).To(MatchError("the payload is not encrypted, encryption is required"))
+	})
+
+	It("verifies payloads signed with a trusted key", func() {
+		envelope, err := SealPayload(payload, bound, key, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(envelope).ToNot(HaveKey("cc"))
+		Expect(OpenPayload(envelope, PayloadPolicy{TrustedKeys: []string{pub}}, nodeKey)).To(Equal(payload))
+
+		_, err = OpenPayload(envelope, PayloadPolicy{TrustedKeys: []string{pub}, RequireEncryption: true}, nodeKey)
+		Expect(err).To(MatchError("the payload is not encrypted, encryption is required"))
+	})
+
+	It("rejects untrusted keys, tampered payloads and other nodes", func() {
+		_, other, err := operator.GenerateKey()
+		Expect(err).ToNot(HaveOccurred())
+		envelope, err := SealPayload(payload, bound, key, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = OpenPayload(envelope, PayloadPolicy{TrustedKeys: []string{other}}, nodeKey)
+		Expect(err).To(MatchError(ContainSubstring("signed with the untrusted key")))
+
+		// Another node sharing the network token has its own key
+		otherNode, err := NewNodeKey()
+		Expect(err).ToNot(HaveOccurred())
+		_, err = OpenPayload(envelope, PayloadPolicy{TrustedKeys: []string{pub}}, otherNode)
+		Expect(err).To(MatchError("invalid payload signature"))
+
+		tampered, err := SealPayload(map[string]string{"cc": "evil"}, "", nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		tampered[signatureField] = envelope[signatureField]
+		tampered[keyField] = envelope[keyField]
+		_, err = OpenPayload(tampered, PayloadPolicy{TrustedKeys: []string{pub}}, nodeKey)
+		Expect(err).To(MatchError("invalid payload signature"))
+	})
+
+	It("only signs for a node key", func() {
+		_, err := SealPayload(payload, "", key, nil)
+		Expect(err).To(MatchError(ContainSubstring("no node key bound")))
+	})
+
+	It("encrypts payloads to the node key", func() {
+		envelope, err := SealPayload(payload, bound, key, nodeKey.Public)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(envelope).To(HaveKeyWithValue(encryptedField, "true"))
+		Expect(OpenPayload(envelope, PayloadPolicy{TrustedKeys: []string{pub}, RequireEncryption: true}, nodeKey)).To(Equal(payload))
+
+		otherKey, err := NewNodeKey()
+		Expect(err).ToNot(HaveOccurred())
+		_, err = OpenPayload(envelope, PayloadPolicy{}, otherKey)
+		Expect(err).To(MatchError("the payload could not be decrypted with the node key"))
+	})
+
+	It("binds the node key to the pairing token", func() {
+		dir := GinkgoT().TempDir()
+		Expect(WriteNodeKey(dir, nodeKey)).To(Succeed())
+		Expect(ReadNodeKey(dir)).To(Equal(nodeKey))
+
+		token, hash := splitToken(BindKey("token", nodeKey))
+		Expect(token).To(Equal("token"))
+		Expect(hash).To(Equal(keyHash(nodeKey.Public)))
+
+		token, hash = splitToken("token")
+		Expect(token).To(Equal("token"))
+		Expect(hash).To(BeEmpty())
+	})
+})
@@ -1,6 +1,8 @@
 package assets
 
-const LocalDNS = `
+import "fmt"
+
+const localDNS = `
 name: DNS Configuration
 stages:
     initramfs:
@@ -11,8 +13,18 @@ stages:
               group: 0
               content: |
                 [Resolve]
-                DNS=127.0.0.1
-        - dns:
+                DNS=%[1]s
+%[2]s        - dns:
             nameservers:
-                - 127.0.0.1
-`
+                - %[1]s
+%[3]s`
+
+// LocalDNS returns the cloud config pointing the system resolver to the edgevpn DNS server.
+func LocalDNS(nameserver, searchDomain string) string {
+	var domains, search string
+	if searchDomain != "" {
+		domains = fmt.Sprintf("                Domains=%s\n", searchDomain)
+		search = fmt.Sprintf("            search:\n                - %s\n", searchDomain)
+	}
+	return fmt.Sprintf(localDNS, nameserver, domains, search)
+}
@@ -2,6 +2,7 @@ package provider
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -12,6 +13,8 @@ import (
 	"github.com/kairos-io/kairos-sdk/machine/systemd"
 	"github.com/kairos-io/kairos-sdk/types"
 	"github.com/kairos-io/kairos-sdk/utils"
+	"github.com/kairos-io/provider-kairos/v2/internal/events"
+	"github.com/kairos-io/provider-kairos/v2/internal/metrics"
 	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
 	"github.com/kairos-io/provider-kairos/v2/internal/role"
 	p2p "github.com/kairos-io/provider-kairos/v2/internal/role/p2p"
@@ -42,6 +45,7 @@ func Bootstrap(e *pluggable.Event) pluggable.EventResponse {
 	if err != nil {
 		return ErrorEvent("Failed reading JSON input: %s input '%s'", err.Error(), cfg.Config)
 	}
+
 	// TODO: this belong to a systemd service that is started instead
 
 	p2pBlockDefined := prvConfig.P2P != nil
@@ -63,12 +67,21 @@ func Bootstrap(e *pluggable.Event) pluggable.EventResponse {
 
 	logger := types.NewKairosLogger("provider", logLevel, false)
 
+	// Configs which booted before the validation was added must keep booting,
+	// only create-config and the pairing payload validation reject them.
+	if err := prvConfig.Validate(); err != nil {
+		logger.Warnf("Invalid configuration: %s", err.Error())
+	}
+
 	// Do onetimebootstrap if a Kubernetes distribution is enabled.
 	// Those blocks are not required to be enabled in case of a kairos
 	// full automated setup. Otherwise, they must be explicitly enabled.
 	if (tokenNotDefined && prvConfig.IsAKubernetesDistributionEnabled()) || skipAuto {
 		err := oneTimeBootstrap(logger, prvConfig, func() error {
-			return SetupVPN(services.EdgeVPNDefaultInstance, cfg.APIAddress, "/", true, prvConfig)
+			if err := SetupVPN(services.EdgeVPNDefaultInstance, cfg.APIAddress, "/", true, prvConfig); err != nil {
+				return err
+			}
+			return SetupNetworks("/", true, prvConfig)
 		})
 		if err != nil {
 			return ErrorEvent("Failed setup: %s", err.Error())
@@ -80,28 +93,77 @@ func Bootstrap(e *pluggable.Event) pluggable.EventResponse {
 		return ErrorEvent("No network token provided, or kubernetes distribution (k3s, k0s) block configured. Exiting")
 	}
 
+	networkID := "kairos"
+
+	if p2pBlockDefined && prvConfig.P2P.NetworkID != "" {
+		networkID = prvConfig.P2P.NetworkID
+	}
+
+	apiClient := edgeVPNClient.NewClient(edgeVPNClient.WithHost(cfg.APIAddress))
+	recorder := events.NewRecorder(apiClient, networkID, machine.UUID())
+	// step records a bootstrap step both in the metrics and in the ledger events
+	step := func(name string, fn func() error) error {
+		err := metrics.Step(name, fn)
+		recorder.Record("", name, err) //nolint:errcheck
+		return err
+	}
+	instrument := func(name string, r role.Role) role.Role {
+		return metrics.Role(name, role.SentinelExist, recorder.Role(name, "kubernetes", r))
+	}
+
+	if prvConfig.P2P.Metrics.Enable {
+		go func() {
+			if err := metrics.Serve(prvConfig.P2P.Metrics.ListenAddress()); err != nil {
+				logger.Errorf("Failed serving metrics: %s", err.Error())
+			}
+		}()
+	}
+
 	// We might still want a VPN, but not to route traffic into
 	if prvConfig.P2P.VPNNeedsCreation() {
 		logger.Info("Configuring VPN")
-		if err := SetupVPN(services.EdgeVPNDefaultInstance, cfg.APIAddress, "/", true, prvConfig); err != nil {
+		if err := step("vpn", func() error {
+			return SetupVPN(services.EdgeVPNDefaultInstance, cfg.APIAddress, "/", true, prvConfig)
+		}); err != nil {
 			return ErrorEvent("Failed setup VPN: %s", err.Error())
 		}
 	} else { // We need at least the API to co-ordinate
 		logger.Info("Configuring API")
-		if err := SetupAPI(cfg.APIAddress, "/", true, prvConfig); err != nil {
+		if err := step("api", func() error {
+			return SetupAPI(cfg.APIAddress, "/", true, prvConfig)
+		}); err != nil {
 			return ErrorEvent("Failed setup VPN: %s", err.Error())
 		}
 	}
 
-	networkID := "kairos"
+	if err := step("networks", func() error {
+		return SetupNetworks("/", true, prvConfig)
+	}); err != nil {
+		return ErrorEvent("Failed setup P2P networks: %s", err.Error())
+	}
 
-	if p2pBlockDefined && prvConfig.P2P.NetworkID != "" {
-		networkID = prvConfig.P2P.NetworkID
+	cc := service.NewClient(networkID, apiClient)
+
+	// The identity key is only needed, and created, when admission is enabled
+	var identity ed25519.PrivateKey
+	if prvConfig.P2P.Admission.Enable {
+		if err := prvConfig.P2P.Admission.Validate(); err != nil {
+			return ErrorEvent("Invalid admission settings: %s", err.Error())
+		}
+		identity, err = role.LoadIdentity(role.IdentityFile)
+		if err != nil {
+			return ErrorEvent("Failed loading node identity: %s", err.Error())
+		}
+	}
+
+	if err := prvConfig.P2P.TokenRotation.Validate(); err != nil {
+		return ErrorEvent("Invalid token rotation settings: %s", err.Error())
 	}
 
-	cc := service.NewClient(
-		networkID,
-		edgeVPNClient.NewClient(edgeVPNClient.WithHost(cfg.APIAddress)))
+	vpnInterface := ""
+	if prvConfig.P2P.VPNNeedsCreation() {
+		vpnInterface = p2p.VPNInterface(prvConfig)
+	}
 
 	nodeOpts := []service.Option{
 		service.WithMinNodes(prvConfig.P2P.MinimumNodes),
@@ -110,28 +172,52 @@ func Bootstrap(e *pluggable.Event) pluggable.EventResponse {
 		service.WithUUID(machine.UUID()),
 		service.WithStateDir("/usr/local/.kairos/state"),
 		service.WithNetworkToken(prvConfig.P2P.NetworkToken),
-		service.WithPersistentRoles("auto"),
+		service.WithPersistentRoles(persistentRoles(prvConfig)),
 		service.WithRoles(
 			service.RoleKey{
 				Role:        "master",
-				RoleHandler: p2p.Master(c, prvConfig, false, false, "master"),
+				RoleHandler: instrument("master", p2p.Master(c, prvConfig, networkID, false, false, "master")),
 			},
 			service.RoleKey{
 				Role:        "master/clusterinit",
-				RoleHandler: p2p.Master(c, prvConfig, true, true, "master/clusterinit"),
+				RoleHandler: instrument("master/clusterinit", p2p.Master(c, prvConfig, networkID, true, true, "master/clusterinit")),
 			},
 			service.RoleKey{
 				Role:        "master/ha",
-				RoleHandler: p2p.Master(c, prvConfig, false, true, "master/ha"),
+				RoleHandler: instrument("master/ha", p2p.Master(c, prvConfig, networkID, false, true, "master/ha")),
 			},
 			service.RoleKey{
 				Role:        "worker",
-				RoleHandler: p2p.Worker(c, prvConfig),
+				RoleHandler: instrument("worker", p2p.Worker(c, prvConfig)),
 			},
 			service.RoleKey{
 				Role:        "auto",
 				RoleHandler: role.Auto(c, prvConfig),
 			},
+			service.RoleKey{
+				Role:        "vpn/address",
+				RoleHandler: role.VPNAddress(prvConfig),
+			},
+			service.RoleKey{
+				Role:        "dns/records",
+				RoleHandler: p2p.DNSRecords(prvConfig, networkID, cfg.APIAddress),
+			},
+			service.RoleKey{
+				Role:        "node/info",
+				RoleHandler: p2p.NodeInfo(prvConfig),
+			},
+			service.RoleKey{
+				Role:        "token/rotation",
+				RoleHandler: tokenRotation(prvConfig, cfg.APIAddress),
+			},
+			service.RoleKey{
+				Role:        "metrics",
+				RoleHandler: metrics.Collector(vpnInterface, role.SentinelExist),
+			},
+			service.RoleKey{
+				Role:        "identity",
+				RoleHandler: role.Identity(identity),
+			},
 		),
 	}
 
@@ -156,6 +242,26 @@ func Bootstrap(e *pluggable.Event) pluggable.EventResponse {
 	}
 }
 
+// persistentRoles are applied on every iteration, regardless of the node assigned role.
+func persistentRoles(c *providerConfig.Config) string {
+	roles := []string{}
+	// The identity is published before the node asks for a role
+	if c.P2P.Admission.Enable {
+		roles = append(roles, "identity")
+	}
+	roles = append(roles, "auto", "node/info", "token/rotation")
+	if c.P2P.VPNNeedsCreation() && c.P2P.VPN.AddressPool != "" {
+		roles = append(roles, "vpn/address")
+	}
+	if c.P2P.DNS.PublishRecords() {
+		roles = append(roles, "dns/records")
+	}
+	if c.P2P.Metrics.Enable {
+		roles = append(roles, "metrics")
+	}
+	return strings.Join(roles, ",")
+}
+
 func oneTimeBootstrap(l types.KairosLogger, c *providerConfig.Config, vpnSetupFN func() error) error {
 	var err error
 	if role.SentinelExist() {
@@ -165,8 +271,9 @@ func oneTimeBootstrap(l types.KairosLogger, c *providerConfig.Config, vpnSetupFN
 	l.Info("One time bootstrap starting")
 
 	var svc machine.Service
-	var svcName, svcRole, envFile, binPath, args string
+	var svcName, svcRole, envFile, binPath string
 	var svcEnv map[string]string
+	var args []string
 
 	if !c.IsAKubernetesDistributionEnabled() {
 		l.Info("No Kubernetes configuration found, skipping bootstrap.")
@@ -177,28 +284,28 @@ func oneTimeBootstrap(l types.KairosLogger, c *providerConfig.Config, vpnSetupFN
 		svcName = "k3s-agent"
 		svcRole = "agent"
 		svcEnv = c.K3sAgent.Env
-		args = strings.Join(c.K3sAgent.Args, " ")
+		args = c.K3sAgent.Args
 	}
 
 	if c.IsK3sEnabled() {
 		svcName = "k3s"
 		svcRole = "server"
 		svcEnv = c.K3s.Env
-		args = strings.Join(c.K3s.Args, " ")
+		args = c.K3s.Args
 	}
 
 	if c.IsK0sEnabled() {
 		svcName = "k0scontroller"
 		svcRole = "controller"
 		svcEnv = c.K0s.Env
-		args = strings.Join(c.K0s.Args, " ")
+		args = c.K0s.Args
 	}
 
 	if c.IsK0sWorkerEnabled() {
 		svcName = "k0sworker"
 		svcRole = "worker"
 		svcEnv = c.K0sWorker.Env
-		args = strings.Join(c.K0sWorker.Args, " ")
+		args = c.K0sWorker.Args
 	}
 
 	if c.IsK3sDistributionEnabled() {
@@ -216,6 +323,21 @@ func oneTimeBootstrap(l types.KairosLogger, c *providerConfig.Config, vpnSetupFN
 		return fmt.Errorf("no %s binary found", svcName)
 	}
 
+	// kube-vip is only meaningful on nodes running the control plane, or as a static pod on agents
+	if c.KubeVIP.IsEnabled() && (c.IsK3sEnabled() || c.IsK3sAgentEnabled() || c.IsK0sEnabled()) {
+		if c.IsK0sEnabled() && !k0sRunsWorkloads(args) {
+			l.Warnf("kube-vip needs a kubelet on the k0s controller, add --enable-worker or --single to k0s.args")
+		}
+		if args, err = kubeVIPSANArgs(c, args); err != nil {
+			l.Errorf("Failed to configure kube-vip SANs: %s", err.Error())
+			return err
+		}
+		if err := p2p.DeployKubeVIP(l, c); err != nil {
+			l.Errorf("Failed KubeVIP setup: %s", err.Error())
+			return err
+		}
+	}
+
 	if err := utils.WriteEnv(envFile, svcEnv); err != nil {
 		l.Errorf("Failed to write %s env file: %s", svcName, err.Error())
 		return err
@@ -237,7 +359,7 @@ func oneTimeBootstrap(l types.KairosLogger, c *providerConfig.Config, vpnSetupFN
 	}
 
 	// Override the service command and start it
-	if err := svc.OverrideCmd(fmt.Sprintf("%s %s %s", binPath, svcRole, args)); err != nil {
+	if err := svc.OverrideCmd(fmt.Sprintf("%s %s %s", binPath, svcRole, strings.Join(args, " "))); err != nil {
 		l.Errorf("Failed to override service command: %s", err.Error())
 		return err
 	}
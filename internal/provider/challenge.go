@@ -6,6 +6,7 @@ import (
 	"github.com/kairos-io/kairos-sdk/bus"
 
 	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/provider-kairos/v2/internal/pairing"
 	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
 
 	"github.com/kairos-io/go-nodepair"
@@ -32,6 +33,18 @@ func Challenge(e *pluggable.Event) pluggable.EventResponse {
 	if tk == "" {
 		tk = nodepair.GenerateToken()
 	}
+	// Nodes built from the same image share the network token: the key bound to the token
+	// shown on screen tells them apart. The install runs in another process, which reads it back.
+	if len(cfg.Pairing.TrustedKeys) > 0 || cfg.Pairing.RequireEncryption {
+		key, err := pairing.NewNodeKey()
+		if err != nil {
+			return ErrorEvent("Failed generating the pairing key: %s", err.Error())
+		}
+		if err := pairing.WriteNodeKey(pairingStateDir, key); err != nil {
+			return ErrorEvent("Failed writing the pairing key: %s", err.Error())
+		}
+		tk = pairing.BindKey(tk, key)
+	}
 	return pluggable.EventResponse{
 		Data: tk,
 	}
@@ -1,24 +1,316 @@
 package config
 
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/provider-kairos/v2/internal/operator"
+	"github.com/multiformats/go-multiaddr"
+	"gopkg.in/yaml.v3"
+)
+
 type P2P struct {
 	NetworkToken string `yaml:"network_token,omitempty"`
 	NetworkID    string `yaml:"network_id,omitempty"`
 	Role         string `yaml:"role,omitempty"`
-	DNS          bool   `yaml:"dns,omitempty"`
+	DNS          DNS    `yaml:"dns,omitempty"`
 	LogLevel     string `yaml:"loglevel,omitempty"`
 	VPN          VPN    `yaml:"vpn,omitempty"`
 
-	MinimumNodes int  `yaml:"minimum_nodes,omitempty"`
-	DisableDHT   bool `yaml:"disable_dht,omitempty"`
-	Auto         Auto `yaml:"auto,omitempty"`
+	MinimumNodes int       `yaml:"minimum_nodes,omitempty"`
+	DisableDHT   bool      `yaml:"disable_dht,omitempty"`
+	Discovery    Discovery `yaml:"discovery,omitempty"`
+	Auto         Auto      `yaml:"auto,omitempty"`
 
 	DynamicRoles bool `yaml:"dynamic_roles,omitempty"`
+
+	MasterChangeDebounce string `yaml:"master_change_debounce,omitempty"`
+	NodeIPCIDR           string `yaml:"node_ip_cidr,omitempty"`
+
+	Networks []Network `yaml:"networks,omitempty"`
+
+	Admission Admission `yaml:"admission,omitempty"`
+
+	TokenRotation TokenRotation `yaml:"token_rotation,omitempty"`
+
+	Metrics Metrics `yaml:"metrics,omitempty"`
+}
+
+// DefaultMetricsListen only serves the metrics locally, as they expose the mesh topology.
+const DefaultMetricsListen = "127.0.0.1:9150"
+
+// Metrics exposes the provider and mesh state in Prometheus format. Set listen
+// to an address reachable by the scraper, e.g. ":9150", to serve them remotely.
+type Metrics struct {
+	Enable bool   `yaml:"enable,omitempty"`
+	Listen string `yaml:"listen,omitempty"`
+}
+
+func (m Metrics) ListenAddress() string {
+	if m.Listen != "" {
+		return m.Listen
+	}
+	return DefaultMetricsListen
+}
+
+// Admission restricts the nodes which take part in role scheduling to the
+// ones approved in the ledger with one of the trusted operator keys, or listed
+// by UUID or key fingerprint in the allowlist.
+type Admission struct {
+	Enable      bool     `yaml:"enable,omitempty"`
+	Allowlist   []string `yaml:"allowlist,omitempty"`
+	TrustedKeys []string `yaml:"trusted_keys,omitempty"`
+}
+
+// Validate checks that nodes can be admitted, and that the trusted keys are operator public keys.
+func (a Admission) Validate() error {
+	if !a.Enable {
+		return nil
+	}
+	if len(a.TrustedKeys) == 0 && len(a.Allowlist) == 0 {
+		return errors.New("p2p.admission requires p2p.admission.trusted_keys to approve nodes, or p2p.admission.allowlist")
+	}
+	for _, k := range a.TrustedKeys {
+		if _, err := operator.ParsePublicKey(k); err != nil {
+			return fmt.Errorf("invalid p2p.admission.trusted_keys: %w", err)
+		}
+	}
+	return nil
+}
+
+// TokenRotation lists the operator keys trusted to rotate the network token.
+// Without any, the rotations published in the ledger are ignored.
+type TokenRotation struct {
+	TrustedKeys []string `yaml:"trusted_keys,omitempty"`
+}
+
+// Validate checks that the trusted keys are operator public keys.
+func (t TokenRotation) Validate() error {
+	for _, k := range t.TrustedKeys {
+		if _, err := operator.ParsePublicKey(k); err != nil {
+			return fmt.Errorf("invalid p2p.token_rotation.trusted_keys: %w", err)
+		}
+	}
+	return nil
+}
+
+// Network is an additional P2P network the node joins next to the
+// one used by the cluster, each one served by its own edgevpn instance.
+type Network struct {
+	Name         string    `yaml:"name,omitempty"`
+	NetworkToken string    `yaml:"network_token,omitempty"`
+	Interface    string    `yaml:"interface,omitempty"`
+	APIAddress   string    `yaml:"api_address,omitempty"`
+	DisableDHT   bool      `yaml:"disable_dht,omitempty"`
+	Discovery    Discovery `yaml:"discovery,omitempty"`
+	VPN          VPN       `yaml:"vpn,omitempty"`
+}
+
+// Network returns the additional network with the given name.
+func (p P2P) Network(name string) (Network, bool) {
+	for i, n := range p.Networks {
+		if n.Name == name {
+			return p.networkWithDefaults(i), true
+		}
+	}
+	return Network{}, false
+}
+
+// networkWithDefaults assigns a distinct interface and API port to networks which don't set them,
+// next to edgevpn0 and port 8080 used by the cluster network.
+func (p P2P) networkWithDefaults(i int) Network {
+	n := p.Networks[i]
+	if n.Interface == "" {
+		n.Interface = fmt.Sprintf("edgevpn%d", i+1)
+	}
+	if n.APIAddress == "" {
+		n.APIAddress = fmt.Sprintf("127.0.0.1:%d", 8081+i)
+	}
+	return n
+}
+
+var networkNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+func (p P2P) ValidateNetworks(defaultInstance string) error {
+	seen := map[string]bool{defaultInstance: true}
+	for _, n := range p.Networks {
+		if !networkNameRegexp.MatchString(n.Name) {
+			return fmt.Errorf("invalid p2p network name '%s'", n.Name)
+		}
+		if seen[n.Name] {
+			return fmt.Errorf("duplicated p2p network name '%s'", n.Name)
+		}
+		if n.NetworkToken == "" {
+			return fmt.Errorf("no network token defined for p2p network '%s'", n.Name)
+		}
+		seen[n.Name] = true
+	}
+	return nil
+}
+
+// Discovery configures how nodes find each other and relay connections,
+// for sites which can't reach the public bootstrap nodes.
+type Discovery struct {
+	// BootstrapPeers are multiaddrs of nodes used to join the DHT, in place of the public ones.
+	BootstrapPeers []string `yaml:"bootstrap_peers,omitempty"`
+	// MDNSOnly disables the DHT and discovers nodes on the local network only.
+	MDNSOnly bool `yaml:"mdns_only,omitempty"`
+	// Relays are multiaddrs of the relays used by nodes behind NAT.
+	Relays           []string `yaml:"relays,omitempty"`
+	StaticRelaysOnly bool     `yaml:"static_relays_only,omitempty"`
+}
+
+func validPeerAddress(addr string) error {
+	maddr, err := multiaddr.NewMultiaddr(addr)
+	if err != nil {
+		return fmt.Errorf("invalid multiaddr '%s': %w", addr, err)
+	}
+	if _, err := maddr.ValueForProtocol(multiaddr.P_P2P); err != nil {
+		return fmt.Errorf("multiaddr '%s' has no /p2p/ peer ID", addr)
+	}
+	return nil
+}
+
+func (d Discovery) Validate(disableDHT bool) error {
+	for _, p := range d.BootstrapPeers {
+		if err := validPeerAddress(p); err != nil {
+			return fmt.Errorf("p2p.discovery.bootstrap_peers: %w", err)
+		}
+	}
+	for _, r := range d.Relays {
+		if err := validPeerAddress(r); err != nil {
+			return fmt.Errorf("p2p.discovery.relays: %w", err)
+		}
+	}
+	if len(d.BootstrapPeers) > 0 && disableDHT {
+		return errors.New("p2p.discovery.bootstrap_peers requires the DHT, unset disable_dht")
+	}
+	if d.MDNSOnly && len(d.BootstrapPeers) > 0 {
+		return errors.New("p2p.discovery.mdns_only can't be used with a DHT configuration")
+	}
+	if d.StaticRelaysOnly && len(d.Relays) == 0 {
+		return errors.New("p2p.discovery.static_relays_only requires relays")
+	}
+	return nil
 }
 
 type VPN struct {
 	Create *bool             `yaml:"create,omitempty"`
 	Use    *bool             `yaml:"use,omitempty"`
 	Env    map[string]string `yaml:"env,omitempty"`
+
+	// Address is a static VPN address in CIDR notation (e.g. 10.1.0.10/24).
+	Address string `yaml:"address,omitempty"`
+	// AddressPool is a CIDR the VPN address is derived from, based on the machine UUID.
+	AddressPool string `yaml:"address_pool,omitempty"`
+}
+
+// UsesDHCP reports whether the VPN address is leased by the network.
+func (v VPN) UsesDHCP() bool {
+	return v.Address == "" && v.AddressPool == ""
+}
+
+func (v VPN) Validate() error {
+	if v.Address != "" && v.AddressPool != "" {
+		return errors.New("p2p.vpn.address and p2p.vpn.address_pool are mutually exclusive")
+	}
+	if v.Address != "" {
+		if ip, _, err := net.ParseCIDR(v.Address); err != nil || ip.To4() == nil {
+			return fmt.Errorf("invalid p2p.vpn.address '%s', an IPv4 address in CIDR notation is required", v.Address)
+		}
+	}
+	if v.AddressPool != "" {
+		_, pool, err := net.ParseCIDR(v.AddressPool)
+		if err != nil || pool.IP.To4() == nil {
+			return fmt.Errorf("invalid p2p.vpn.address_pool '%s', an IPv4 CIDR is required", v.AddressPool)
+		}
+		if ones, bits := pool.Mask.Size(); bits-ones < 2 {
+			return fmt.Errorf("p2p.vpn.address_pool '%s' is too small", v.AddressPool)
+		}
+	}
+	return nil
+}
+
+// DNS configures the DNS server embedded in edgevpn. It can be set either to a boolean,
+// or to a block with the server settings, in which case it is enabled unless disabled explicitly.
+type DNS struct {
+	Enable       *bool    `yaml:"enable,omitempty"`
+	Listen       string   `yaml:"listen,omitempty"`
+	Forwarders   []string `yaml:"forwarders,omitempty"`
+	CacheSize    int      `yaml:"cache_size,omitempty"`
+	SearchDomain string   `yaml:"search_domain,omitempty"`
+	// Records toggles publishing the node, api and master records of the cluster.
+	Records *bool `yaml:"records,omitempty"`
+}
+
+const DefaultDNSListen = "127.0.0.1:53"
+
+func (d *DNS) UnmarshalYAML(value *yaml.Node) error {
+	var enabled bool
+	if value.Kind == yaml.ScalarNode {
+		if err := value.Decode(&enabled); err != nil {
+			return fmt.Errorf("p2p.dns: %w", err)
+		}
+		*d = DNS{Enable: &enabled}
+		return nil
+	}
+
+	type plain DNS
+	var p plain
+	if err := value.Decode(&p); err != nil {
+		return err
+	}
+	if p.Enable == nil {
+		enabled = true
+		p.Enable = &enabled
+	}
+	*d = DNS(p)
+	return nil
+}
+
+func (d DNS) IsEnabled() bool {
+	return d.Enable != nil && *d.Enable
+}
+
+// ListenAddress returns the address the DNS server binds to.
+func (d DNS) ListenAddress() string {
+	if d.Listen != "" {
+		return d.Listen
+	}
+	return DefaultDNSListen
+}
+
+// Nameserver returns the address the system resolver should query.
+func (d DNS) Nameserver() string {
+	host, _, err := net.SplitHostPort(d.ListenAddress())
+	if err != nil || host == "" || host == "0.0.0.0" || host == "::" {
+		return "127.0.0.1"
+	}
+	return host
+}
+
+func (d DNS) PublishRecords() bool {
+	return d.IsEnabled() && (d.Records == nil || *d.Records)
+}
+
+func (d DNS) Validate() error {
+	if _, port, err := net.SplitHostPort(d.ListenAddress()); err != nil || port == "" {
+		return fmt.Errorf("invalid p2p.dns.listen '%s'", d.Listen)
+	}
+	for _, f := range d.Forwarders {
+		if _, _, err := net.SplitHostPort(f); err != nil {
+			return fmt.Errorf("invalid p2p.dns forwarder '%s', host:port is required", f)
+		}
+	}
+	if d.CacheSize < 0 {
+		return errors.New("p2p.dns.cache_size can't be negative")
+	}
+	return nil
 }
 
 // If no setting is provided by the user,
@@ -32,6 +324,19 @@ func (p P2P) VPNNeedsCreation() bool {
 	return p.VPN.Create == nil || *p.VPN.Create
 }
 
+// MasterChangeDebounceDuration returns how long a new master IP has to be
+// published before already joined workers are reconfigured to use it.
+func (p P2P) MasterChangeDebounceDuration() (time.Duration, error) {
+	if p.MasterChangeDebounce == "" {
+		return 2 * time.Minute, nil
+	}
+	d, err := time.ParseDuration(p.MasterChangeDebounce)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid p2p.master_change_debounce '%s', a positive duration is required", p.MasterChangeDebounce)
+	}
+	return d, nil
+}
+
 type Config struct {
 	P2P       *P2P    `yaml:"p2p,omitempty"`
 	K3sAgent  K3s     `yaml:"k3s-agent,omitempty"`
@@ -39,6 +344,27 @@ type Config struct {
 	KubeVIP   KubeVIP `yaml:"kubevip,omitempty"`
 	K0sWorker K0s     `yaml:"k0s-worker,omitempty"`
 	K0s       K0s     `yaml:"k0s,omitempty"`
+	Pairing   Pairing `yaml:"pairing,omitempty"`
+}
+
+// Pairing restricts the payloads a node in pairing mode installs to the ones
+// signed with a trusted operator key, and encrypted to the node if required.
+// Encryption requires trusted keys, as it doesn't tell who sent the payload.
+type Pairing struct {
+	TrustedKeys       []string `yaml:"trusted_keys,omitempty"`
+	RequireEncryption bool     `yaml:"require_encryption,omitempty"`
+}
+
+func (p Pairing) Validate() error {
+	for _, k := range p.TrustedKeys {
+		if _, err := operator.ParsePublicKey(k); err != nil {
+			return fmt.Errorf("invalid pairing.trusted_keys: %w", err)
+		}
+	}
+	if p.RequireEncryption && len(p.TrustedKeys) == 0 {
+		return errors.New("pairing.require_encryption requires pairing.trusted_keys")
+	}
+	return nil
 }
 
 func (c Config) IsK3sAgentEnabled() bool {
@@ -69,19 +395,207 @@ func (c Config) IsAKubernetesDistributionEnabled() bool {
 	return c.IsK3sAgentEnabled() || c.IsK3sEnabled() || c.IsK0sEnabled() || c.IsK0sWorkerEnabled()
 }
 
+const (
+	DefaultKubeVIPImage              = "ghcr.io/kube-vip/kube-vip"
+	DefaultKubeVIPVersion            = "v0.8.9"
+	DefaultKubeVIPCloudProviderImage = "ghcr.io/kube-vip/kube-vip-cloud-provider:v0.0.10"
+)
+
+// KubeVIP configures kube-vip on the control plane nodes. On k0s, it runs as a pod
+// and therefore needs the controllers to run a kubelet too (--enable-worker).
 type KubeVIP struct {
-	Args        []string `yaml:"args,omitempty"`
-	EIP         string   `yaml:"eip,omitempty"`
-	ManifestURL string   `yaml:"manifest_url,omitempty"`
-	Interface   string   `yaml:"interface,omitempty"`
-	Enable      *bool    `yaml:"enable,omitempty"`
-	StaticPod   bool     `yaml:"static_pod,omitempty"`
+	// Deprecated: kube-vip is not invoked anymore to generate the manifest, use Env instead.
+	// The known flags are translated to the matching variables, see ArgsEnv.
+	Args           []string          `yaml:"args,omitempty"`
+	EIP            string            `yaml:"eip,omitempty"`
+	ManifestURL    string            `yaml:"manifest_url,omitempty"`
+	ManifestSHA256 string            `yaml:"manifest_sha256,omitempty"`
+	Interface      string            `yaml:"interface,omitempty"`
+	Enable         *bool             `yaml:"enable,omitempty"`
+	StaticPod      bool              `yaml:"static_pod,omitempty"`
+	Image          string            `yaml:"image,omitempty"`
+	Version        string            `yaml:"version,omitempty"`
+	ARP            *bool             `yaml:"arp,omitempty"`
+	LeaderElection *bool             `yaml:"leader_election,omitempty"`
+	ControlPlane   *bool             `yaml:"control_plane,omitempty"`
+	Services       bool              `yaml:"services,omitempty"`
+	Env            map[string]string `yaml:"env,omitempty"`
+
+	BGP KubeVIPBGP `yaml:"bgp,omitempty"`
+
+	// ServicesIPRanges maps a namespace (or "global") to the IP range or CIDR
+	// used to allocate LoadBalancer addresses by the kube-vip cloud provider.
+	ServicesIPRanges   map[string]string `yaml:"services_ip_ranges,omitempty"`
+	CloudProviderImage string            `yaml:"cloud_provider_image,omitempty"`
+}
+
+type KubeVIPBGP struct {
+	Enable   bool             `yaml:"enable,omitempty"`
+	RouterID string           `yaml:"router_id,omitempty"`
+	AS       uint32           `yaml:"as,omitempty"`
+	PeerAS   uint32           `yaml:"peer_as,omitempty"`
+	Peers    []KubeVIPBGPPeer `yaml:"peers,omitempty"`
+}
+
+type KubeVIPBGPPeer struct {
+	Address  string `yaml:"address,omitempty"`
+	AS       uint32 `yaml:"as,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	Multihop bool   `yaml:"multihop,omitempty"`
 }
 
 func (k KubeVIP) IsEnabled() bool {
 	return (k.Enable == nil && k.EIP != "") || (k.Enable != nil && *k.Enable)
 }
 
+// ImageRef returns the kube-vip container image, pinned to the configured version.
+func (k KubeVIP) ImageRef() string {
+	image, version := k.Image, k.Version
+	if image == "" {
+		image = DefaultKubeVIPImage
+	}
+	if version == "" {
+		version = DefaultKubeVIPVersion
+	}
+	return image + ":" + version
+}
+
+// IsARPEnabled defaults to ARP mode unless BGP is enabled.
+func (k KubeVIP) IsARPEnabled() bool {
+	return (k.ARP == nil && !k.BGP.Enable) || (k.ARP != nil && *k.ARP)
+}
+
+func (k KubeVIP) IsLeaderElectionEnabled() bool {
+	return k.LeaderElection == nil || *k.LeaderElection
+}
+
+func (k KubeVIP) IsControlPlaneEnabled() bool {
+	return k.ControlPlane == nil || *k.ControlPlane
+}
+
+// IsLoadBalancerEnabled reports whether kube-vip should serve LoadBalancer Services.
+func (k KubeVIP) IsLoadBalancerEnabled() bool {
+	return k.Services || len(k.ServicesIPRanges) > 0
+}
+
+func (k KubeVIP) CloudProviderImageRef() string {
+	if k.CloudProviderImage != "" {
+		return k.CloudProviderImage
+	}
+	return DefaultKubeVIPCloudProviderImage
+}
+
+func (k KubeVIP) Validate() error {
+	if k.BGP.Enable {
+		if k.BGP.AS == 0 {
+			return errors.New("kubevip.bgp.as is required when BGP is enabled")
+		}
+		if len(k.BGP.Peers) == 0 {
+			return errors.New("kubevip.bgp.peers needs at least one peer when BGP is enabled")
+		}
+		for _, p := range k.BGP.Peers {
+			if net.ParseIP(p.Address) == nil {
+				return fmt.Errorf("invalid kubevip.bgp peer address '%s'", p.Address)
+			}
+			if p.AS == 0 && k.BGP.PeerAS == 0 {
+				return fmt.Errorf("no AS defined for kubevip.bgp peer '%s'", p.Address)
+			}
+			// Peers are passed to kube-vip as <address>:<AS>:<password>:<multihop>,...
+			if strings.ContainsAny(p.Password, ":,") {
+				return fmt.Errorf("the password of kubevip.bgp peer '%s' can't contain ':' or ','", p.Address)
+			}
+		}
+		if k.BGP.RouterID != "" && net.ParseIP(k.BGP.RouterID) == nil {
+			return fmt.Errorf("invalid kubevip.bgp.router_id '%s'", k.BGP.RouterID)
+		}
+	}
+
+	for ns, r := range k.ServicesIPRanges {
+		cidrs, ranges := 0, 0
+		for _, part := range strings.Split(r, ",") {
+			part = strings.TrimSpace(part)
+			if _, _, err := net.ParseCIDR(part); err == nil {
+				cidrs++
+				continue
+			}
+			ips := strings.Split(part, "-")
+			if len(ips) != 2 || net.ParseIP(strings.TrimSpace(ips[0])) == nil || net.ParseIP(strings.TrimSpace(ips[1])) == nil {
+				return fmt.Errorf("invalid kubevip.services_ip_ranges entry for '%s': '%s'", ns, r)
+			}
+			ranges++
+		}
+		if cidrs > 0 && ranges > 0 {
+			return fmt.Errorf("kubevip.services_ip_ranges entry for '%s' mixes CIDRs and ranges: '%s'", ns, r)
+		}
+	}
+
+	_, err := k.ArgsEnv()
+	return err
+}
+
+// kubeVIPArgsEnv maps the kube-vip manifest flags to the variables they set.
+var kubeVIPArgsEnv = map[string]string{
+	"interface":            "vip_interface",
+	"vip":                  "address",
+	"address":              "address",
+	"cidr":                 "vip_cidr",
+	"vipSubnet":            "vip_subnet",
+	"arp":                  "vip_arp",
+	"controlplane":         "cp_enable",
+	"services":             "svc_enable",
+	"leaderElection":       "vip_leaderelection",
+	"leaseDuration":        "vip_leaseduration",
+	"leaseRenewDuration":   "vip_renewdeadline",
+	"leaseRetry":           "vip_retryperiod",
+	"bgp":                  "bgp_enable",
+	"localAS":              "bgp_as",
+	"bgpRouterID":          "bgp_routerid",
+	"bgppeers":             "bgp_peers",
+	"peerAS":               "bgp_peeras",
+	"peerAddress":          "bgp_peeraddress",
+	"peerPass":             "bgp_peerpass",
+	"enableLoadBalancer":   "lb_enable",
+	"lbPort":               "lb_port",
+	"prometheusHTTPServer": "prometheus_server",
+}
+
+// kubeVIPManifestArgs are the kube-vip manifest flags the generated manifest already covers.
+var kubeVIPManifestArgs = []string{"inCluster", "taint"}
+
+// ArgsEnv translates the deprecated kubevip.args to the kube-vip variables.
+// Flags with no matching variable are errors, rather than being silently dropped.
+func (k KubeVIP) ArgsEnv() (map[string]string, error) {
+	env := map[string]string{}
+	args := []string{}
+	for _, a := range k.Args {
+		args = append(args, strings.Fields(a)...)
+	}
+
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") {
+			return nil, fmt.Errorf("unexpected kubevip.args value '%s'", args[i])
+		}
+		flag, value, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		if slices.Contains(kubeVIPManifestArgs, flag) {
+			continue
+		}
+		name, ok := kubeVIPArgsEnv[flag]
+		if !ok {
+			return nil, fmt.Errorf("kubevip.args '%s' is not supported anymore, set the matching kube-vip variable in kubevip.env instead", args[i])
+		}
+		if !hasValue {
+			// Boolean flags are given alone
+			value = "true"
+			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+		}
+		env[name] = value
+	}
+	return env, nil
+}
+
 type Auto struct {
 	Enable *bool `yaml:"enable,omitempty"`
 	HA     HA    `yaml:"ha,omitempty"`
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+var staticRoles = []string{"master", "master/clusterinit", "master/ha", "worker", "none"}
+
+func (p P2P) Validate() error {
+	if p.Role != "" {
+		valid := false
+		for _, r := range staticRoles {
+			valid = valid || p.Role == r
+		}
+		if !valid {
+			return fmt.Errorf("invalid p2p.role '%s', one of %v is required", p.Role, staticRoles)
+		}
+	}
+	if p.MinimumNodes < 0 {
+		return errors.New("p2p.minimum_nodes can't be negative")
+	}
+	if p.NodeIPCIDR != "" {
+		if _, _, err := net.ParseCIDR(p.NodeIPCIDR); err != nil {
+			return fmt.Errorf("invalid p2p.node_ip_cidr '%s'", p.NodeIPCIDR)
+		}
+	}
+	if _, err := p.MasterChangeDebounceDuration(); err != nil {
+		return err
+	}
+
+	ha := p.Auto.HA
+	if ha.MasterNodes != nil && *ha.MasterNodes < 0 {
+		return errors.New("p2p.auto.ha.master_nodes can't be negative")
+	}
+	if ha.ExternalDB != "" && !ha.IsEnabled() {
+		return errors.New("p2p.auto.ha.external_db requires p2p.auto.ha")
+	}
+
+	if err := p.VPN.Validate(); err != nil {
+		return err
+	}
+	if err := p.Admission.Validate(); err != nil {
+		return err
+	}
+	if err := p.TokenRotation.Validate(); err != nil {
+		return err
+	}
+	if p.DNS.IsEnabled() {
+		if err := p.DNS.Validate(); err != nil {
+			return err
+		}
+	}
+	return p.Discovery.Validate(p.DisableDHT)
+}
+
+// Validate checks the settings which can't be told apart until the node bootstraps.
+// k3s and k3s-agent can be enabled together, as P2P clusters share one config
+// between masters and workers and the role picks the service.
+func (c Config) Validate() error {
+	if (c.IsK3sEnabled() || c.IsK3sAgentEnabled()) && c.IsK0sDistributionEnabled() {
+		return errors.New("k3s and k0s can't be enabled together")
+	}
+
+	if c.P2P != nil {
+		if err := c.P2P.Validate(); err != nil {
+			return err
+		}
+		if c.P2P.NetworkToken != "" && c.P2P.Auto.IsEnabled() && c.IsK0sDistributionEnabled() {
+			return errors.New("clusters formed over P2P use k3s, disable p2p.auto to use k0s")
+		}
+	}
+
+	if err := c.Pairing.Validate(); err != nil {
+		return err
+	}
+
+	if c.KubeVIP.EIP != "" && net.ParseIP(c.KubeVIP.EIP) == nil {
+		return fmt.Errorf("invalid kubevip.eip '%s'", c.KubeVIP.EIP)
+	}
+	return c.KubeVIP.Validate()
+}
@@ -3,13 +3,59 @@ package provider
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
 
 	"github.com/kairos-io/kairos-sdk/bus"
 
-	"github.com/kairos-io/go-nodepair"
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/provider-kairos/v2/internal/pairing"
+	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
 	"github.com/mudler/go-pluggable"
+	process "github.com/mudler/go-processmanager"
 )
 
+// pairingStateDir holds the install progress relayed to the registering operator.
+const pairingStateDir = "/run/kairos-pairing"
+
+// pairingStagesFile holds the stages reporting the install progress. The agent
+// runs the stages of /system/oem but doesn't read it for the configuration it
+// installs, and the installed node gets its own /system/oem from the image.
+const pairingStagesFile = "/system/oem/95_kairos_pairing.yaml"
+
+// payloadPolicy reads the payload requirements from the config of the image.
+func payloadPolicy(cfg string) (pairing.PayloadPolicy, error) {
+	c := &providerConfig.Config{}
+	if err := config.FromString(cfg, c); err != nil {
+		return pairing.PayloadPolicy{}, err
+	}
+	if err := c.Pairing.Validate(); err != nil {
+		return pairing.PayloadPolicy{}, err
+	}
+	return pairing.PayloadPolicy{TrustedKeys: c.Pairing.TrustedKeys, RequireEncryption: c.Pairing.RequireEncryption}, nil
+}
+
+// startPairingRelay keeps reporting the result and the install progress once the plugin returned.
+// A relay left by a previous pairing is stopped first.
+func startPairingRelay(token string) error {
+	stateDir := pairingStateDir + "/relay"
+	process.New(process.WithStateDir(stateDir)).Stop() //nolint:errcheck
+	pairing.Reset(pairingStateDir)
+
+	relay := process.New(
+		process.WithName(os.Args[0]),
+		process.WithArgs("pairing-relay"),
+		process.WithEnvironment(
+			fmt.Sprintf("TOKEN=%s", token),
+			fmt.Sprintf("STATE_DIR=%s", pairingStateDir),
+			fmt.Sprintf("AGENT_PID=%d", os.Getppid()),
+		),
+		process.WithStateDir(stateDir),
+	)
+	return relay.Run()
+}
+
 func Install(e *pluggable.Event) pluggable.EventResponse {
 	cfg := &bus.InstallPayload{}
 	err := json.Unmarshal([]byte(e.Data), cfg)
@@ -17,11 +63,63 @@ func Install(e *pluggable.Event) pluggable.EventResponse {
 		return ErrorEvent("Failed reading JSON input: %s", err.Error())
 	}
 
-	r := map[string]string{}
-	ctx := context.Background()
-	if err := nodepair.Receive(ctx, &r, nodepair.WithToken(cfg.Token)); err != nil {
+	// Don't pair at all rather than ignore the trusted keys of an unreadable config
+	policy, err := payloadPolicy(cfg.Config)
+	if err != nil {
+		return ErrorEvent("Failed reading the pairing settings: %s", err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := pairing.Open(ctx, cfg.Token, "")
+	if err != nil {
 		return ErrorEvent("Failed reading JSON input: %s", err.Error())
 	}
+	// Payloads are only signed for, and encrypted to, the key bound to the token by the challenge
+	var nodeKey *pairing.NodeKey
+	if policy.NeedsNodeKey() {
+		if nodeKey, err = pairing.ReadNodeKey(pairingStateDir); err != nil {
+			return ErrorEvent("Failed reading the pairing key: %s", err.Error())
+		}
+		ch.ReportKey(nodeKey)
+	}
+	ch.ReportFacts(pairing.LocalFacts())
+
+	envelope := map[string]string{}
+	if err := ch.Receive(ctx, &envelope); err != nil {
+		return ErrorEvent("Failed reading JSON input: %s", err.Error())
+	}
+
+	result := pairing.Result{}
+	r, err := pairing.OpenPayload(envelope, policy, nodeKey)
+	if err != nil {
+		result.Errors = []string{err.Error()}
+	} else {
+		result.Errors = pairing.ValidatePayload(r)
+	}
+	result.Accepted = len(result.Errors) == 0
+	if result.Accepted {
+		_, reboot := r["reboot"]
+		_, poweroff := r["poweroff"]
+		if err := pairing.WriteHookStages(pairingStagesFile, pairingStateDir, pairing.FinalStage(reboot, poweroff)); err != nil {
+			return ErrorEvent("Failed adding the install progress stages: %s", err.Error())
+		}
+	} else {
+		os.Remove(pairingStagesFile) //nolint:errcheck
+	}
+
+	ch.Reply(result)
+	if err := pairing.WriteResult(pairingStateDir, result); err != nil {
+		return ErrorEvent("Failed writing the pairing result: %s", err.Error())
+	}
+	if err := startPairingRelay(cfg.Token); err != nil {
+		return ErrorEvent("Failed starting the pairing relay: %s", err.Error())
+	}
+
+	if !result.Accepted {
+		return ErrorEvent("Invalid configuration received: %s", strings.Join(result.Errors, ", "))
+	}
 
 	payload, err := json.Marshal(r)
 	if err != nil {
@@ -0,0 +1,78 @@
+package provider
+
+import (
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-sdk/unstructured"
+	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gopkg.in/yaml.v3"
+)
+
+var _ = Describe("Interactive install", func() {
+	// answer builds the config the installer writes, where every answer is a string
+	answer := func(answers map[string]interface{}) *providerConfig.Config {
+		m, err := unstructured.ToYAMLMap(answers)
+		Expect(err).ToNot(HaveOccurred())
+		dat, err := yaml.Marshal(m)
+		Expect(err).ToNot(HaveOccurred())
+		c := &providerConfig.Config{}
+		Expect(config.FromString(string(dat), c)).To(Succeed())
+		return c
+	}
+
+	It("asks for the cluster topology", func() {
+		sections := []string{}
+		for _, p := range interactivePrompts() {
+			sections = append(sections, p.YAMLSection)
+		}
+		Expect(sections).To(ContainElements("p2p.auto.ha.enable", "p2p.role", "p2p.dns", "kubevip.eip", "k3s.enabled", "k0s.enabled"))
+	})
+
+	It("reads the answers", func() {
+		c := answer(map[string]interface{}{
+			"p2p.network_token":  "token",
+			"p2p.auto.ha.enable": "true",
+			"p2p.role":           "master/ha",
+			"p2p.dns":            "true",
+			"kubevip.eip":        "10.0.0.10",
+			"k3s.enabled":        "true",
+			"k0s.enabled":        "false",
+		})
+		Expect(c.Validate()).To(Succeed())
+		Expect(c.P2P.Auto.HA.IsEnabled()).To(BeTrue())
+		Expect(c.P2P.DNS.IsEnabled()).To(BeTrue())
+		Expect(c.IsK3sEnabled()).To(BeTrue())
+		Expect(c.IsK0sEnabled()).To(BeFalse())
+	})
+
+	It("rejects inconsistent answers", func() {
+		Expect(answer(map[string]interface{}{
+			"p2p.network_token": "token",
+			"k0s.enabled":       "true",
+		}).Validate()).To(HaveOccurred())
+
+		Expect(answer(map[string]interface{}{
+			"p2p.network_token":       "token",
+			"p2p.auto.ha.enable":      "false",
+			"p2p.auto.ha.external_db": "mysql://db",
+		}).Validate()).To(MatchError(ContainSubstring("external_db")))
+
+		Expect(answer(map[string]interface{}{
+			"p2p.role": "controller",
+		}).Validate()).To(MatchError(ContainSubstring("p2p.role")))
+
+		Expect(answer(map[string]interface{}{
+			"k3s.enabled": "true",
+			"k0s.enabled": "true",
+		}).Validate()).To(HaveOccurred())
+	})
+
+	It("accepts a P2P config shared by masters and workers", func() {
+		Expect(answer(map[string]interface{}{
+			"p2p.network_token": "token",
+			"k3s.enabled":       "true",
+			"k3s-agent.enabled": "true",
+		}).Validate()).To(Succeed())
+	})
+})
@@ -0,0 +1,105 @@
+package provider
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
+	"gopkg.in/yaml.v3"
+)
+
+const k0sDefaultConfig = "/etc/k0s/k0s.yaml"
+
+// kubeVIPSANArgs makes the distribution API server certificate valid for the kube-vip address.
+// k3s takes the SANs as arguments, while k0s reads them from its configuration file.
+// Agents run no API server, so they are left untouched.
+func kubeVIPSANArgs(c *providerConfig.Config, args []string) ([]string, error) {
+	vip := c.KubeVIP.EIP
+	if vip == "" || (c.IsK3sAgentEnabled() && !c.IsK3sEnabled()) {
+		return args, nil
+	}
+
+	if c.IsK0sEnabled() {
+		return args, addK0sSAN(k0sConfigFile(args), vip)
+	}
+
+	san := fmt.Sprintf("--tls-san=%s", vip)
+	if !slices.Contains(args, san) {
+		args = append(args, san)
+	}
+	return args, nil
+}
+
+// k0sRunsWorkloads tells if the k0s controller runs a kubelet, which the kube-vip
+// DaemonSet needs to be scheduled on it. Plain controllers run no kubelet at all.
+func k0sRunsWorkloads(args []string) bool {
+	for _, a := range args {
+		switch a {
+		case "--enable-worker", "--enable-worker=true", "--single", "--single=true":
+			return true
+		}
+	}
+	return false
+}
+
+// k0sConfigFile returns the configuration file passed to k0s, or the one it loads by default.
+func k0sConfigFile(args []string) string {
+	for i, a := range args {
+		for _, flag := range []string{"--config", "-c"} {
+			if a == flag && i+1 < len(args) {
+				return args[i+1]
+			}
+			if strings.HasPrefix(a, flag+"=") {
+				return strings.TrimPrefix(a, flag+"=")
+			}
+		}
+	}
+	return k0sDefaultConfig
+}
+
+func addK0sSAN(file, san string) error {
+	cfg := map[string]interface{}{}
+
+	dat, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := yaml.Unmarshal(dat, &cfg); err != nil {
+		return fmt.Errorf("could not parse %s: %w", file, err)
+	}
+
+	if _, ok := cfg["apiVersion"]; !ok {
+		cfg["apiVersion"] = "k0s.k0sproject.io/v1beta1"
+		cfg["kind"] = "ClusterConfig"
+		cfg["metadata"] = map[string]interface{}{"name": "k0s"}
+	}
+
+	spec, _ := cfg["spec"].(map[string]interface{})
+	if spec == nil {
+		spec = map[string]interface{}{}
+	}
+	api, _ := spec["api"].(map[string]interface{})
+	if api == nil {
+		api = map[string]interface{}{}
+	}
+	sans, _ := api["sans"].([]interface{})
+	if slices.Contains(sans, interface{}(san)) {
+		return nil
+	}
+	api["sans"] = append(sans, san)
+	spec["api"] = api
+	cfg["spec"] = spec
+
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+		return err
+	}
+	return os.WriteFile(file, out, 0600)
+}
@@ -0,0 +1,65 @@
+package provider
+
+import (
+	"os"
+	"path/filepath"
+
+	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gopkg.in/yaml.v3"
+)
+
+var _ = Describe("KubeVIP SANs", func() {
+	It("adds the VIP as k3s tls-san only once", func() {
+		c := &providerConfig.Config{K3s: providerConfig.K3s{Enabled: true}, KubeVIP: providerConfig.KubeVIP{EIP: "10.0.0.100"}}
+
+		args, err := kubeVIPSANArgs(c, []string{"--disable=traefik"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(args).To(Equal([]string{"--disable=traefik", "--tls-san=10.0.0.100"}))
+
+		args, err = kubeVIPSANArgs(c, args)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(args).To(HaveLen(2))
+	})
+
+	It("leaves the k3s agent arguments untouched", func() {
+		c := &providerConfig.Config{K3sAgent: providerConfig.K3s{Enabled: true}, KubeVIP: providerConfig.KubeVIP{EIP: "10.0.0.100"}}
+
+		args, err := kubeVIPSANArgs(c, []string{"--with-node-id"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(args).To(Equal([]string{"--with-node-id"}))
+	})
+
+	It("detects k0s controllers running a kubelet", func() {
+		Expect(k0sRunsWorkloads([]string{"--enable-worker"})).To(BeTrue())
+		Expect(k0sRunsWorkloads([]string{"--single=true"})).To(BeTrue())
+		Expect(k0sRunsWorkloads([]string{"--config", "/etc/k0s/k0s.yaml"})).To(BeFalse())
+	})
+
+	It("adds the VIP to the k0s configuration file", func() {
+		dir, err := os.MkdirTemp("", "k0s")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		file := filepath.Join(dir, "k0s.yaml")
+		Expect(os.WriteFile(file, []byte("apiVersion: k0s.k0sproject.io/v1beta1\nkind: ClusterConfig\nspec:\n  api:\n    sans:\n    - 192.168.1.1\n"), 0600)).To(Succeed())
+
+		c := &providerConfig.Config{K0s: providerConfig.K0s{Enabled: true}, KubeVIP: providerConfig.KubeVIP{EIP: "10.0.0.100"}}
+		args, err := kubeVIPSANArgs(c, []string{"--config", file})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(args).To(Equal([]string{"--config", file}))
+
+		dat, err := os.ReadFile(file)
+		Expect(err).ToNot(HaveOccurred())
+		cfg := struct {
+			Spec struct {
+				API struct {
+					SANs []string `yaml:"sans"`
+				} `yaml:"api"`
+			} `yaml:"spec"`
+		}{}
+		Expect(yaml.Unmarshal(dat, &cfg)).To(Succeed())
+		Expect(cfg.Spec.API.SANs).To(Equal([]string{"192.168.1.1", "10.0.0.100"}))
+	})
+})
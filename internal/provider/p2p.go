@@ -5,9 +5,12 @@ import (
 	"io/ioutil" // nolint
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
+	"github.com/joho/godotenv"
 	"github.com/kairos-io/provider-kairos/v2/internal/provider/assets"
+	"github.com/kairos-io/provider-kairos/v2/internal/role"
 
 	"github.com/kairos-io/kairos-sdk/machine"
 	"github.com/kairos-io/kairos-sdk/machine/systemd"
@@ -33,22 +36,26 @@ func SetupAPI(apiAddress, rootDir string, start bool, c *providerConfig.Config)
 	apiAddress = strings.ReplaceAll(apiAddress, "https://", "")
 	apiAddress = strings.ReplaceAll(apiAddress, "http://", "")
 
+	if err := c.P2P.Discovery.Validate(c.P2P.DisableDHT); err != nil {
+		return err
+	}
+
 	vpnOpts := map[string]string{
 		"EDGEVPNTOKEN": c.P2P.NetworkToken,
 		"APILISTEN":    apiAddress,
 	}
-	// Override opts with user-supplied
-	for k, v := range c.P2P.VPN.Env {
+	for k, v := range discoveryEnv(c.P2P.Discovery, c.P2P.DisableDHT) {
 		vpnOpts[k] = v
 	}
 
-	if c.P2P.DisableDHT {
-		vpnOpts["EDGEVPNDHT"] = "false"
+	// Override opts with user-supplied
+	for k, v := range c.P2P.VPN.Env {
+		vpnOpts[k] = v
 	}
 
 	os.MkdirAll("/etc/systemd/system.conf.d/", 0600) //nolint:errcheck
 	// Setup edgevpn instance
-	err = utils.WriteEnv(filepath.Join(rootDir, "/etc/systemd/system.conf.d/edgevpn-kairos.env"), vpnOpts)
+	err = utils.WriteEnv(filepath.Join(rootDir, services.EdgeVPNEnvFile(services.EdgeVPNDefaultInstance)), vpnOpts)
 	if err != nil {
 		return fmt.Errorf("could not create write env file: %w", err)
 	}
@@ -69,44 +76,136 @@ func SetupAPI(apiAddress, rootDir string, start bool, c *providerConfig.Config)
 	return nil
 }
 
+// discoveryEnv renders the discovery settings into edgevpn options.
+func discoveryEnv(d providerConfig.Discovery, disableDHT bool) map[string]string {
+	opts := map[string]string{}
+	if disableDHT {
+		opts["EDGEVPNDHT"] = "false"
+	}
+	if len(d.BootstrapPeers) > 0 {
+		opts["EDGEVPNBOOTSTRAPPEERS"] = strings.Join(d.BootstrapPeers, ",")
+	}
+	if d.MDNSOnly {
+		opts["EDGEVPNDHT"] = "false"
+		opts["EDGEVPNMDNS"] = "true"
+	}
+	if len(d.Relays) > 0 {
+		opts["EDGEVPNAUTORELAY"] = "true"
+		opts["EDGEVPNAUTORELAYPEERS"] = strings.Join(d.Relays, ",")
+	}
+	if d.StaticRelaysOnly {
+		opts["EDGEVPNAUTORELAYSTATICONLY"] = "true"
+	}
+	return opts
+}
+
+// vpnInstance holds the settings of the edgevpn instance serving a network.
+type vpnInstance struct {
+	token, apiAddress, iface, leaseDir string
+	disableDHT                         bool
+	discovery                          providerConfig.Discovery
+	vpn                                providerConfig.VPN
+}
+
+func vpnInstanceFor(instance, apiAddress string, c *providerConfig.Config) (vpnInstance, error) {
+	if instance == services.EdgeVPNDefaultInstance {
+		v := vpnInstance{apiAddress: apiAddress, leaseDir: "/usr/local/.kairos/lease"}
+		if c.P2P != nil {
+			v.token = c.P2P.NetworkToken
+			v.disableDHT = c.P2P.DisableDHT
+			v.discovery = c.P2P.Discovery
+			v.vpn = c.P2P.VPN
+		}
+		return v, nil
+	}
+
+	if c.P2P == nil {
+		return vpnInstance{}, fmt.Errorf("no p2p network '%s' defined", instance)
+	}
+	n, exists := c.P2P.Network(instance)
+	if !exists {
+		return vpnInstance{}, fmt.Errorf("no p2p network '%s' defined", instance)
+	}
+	return vpnInstance{
+		token:      n.NetworkToken,
+		apiAddress: n.APIAddress,
+		iface:      n.Interface,
+		leaseDir:   fmt.Sprintf("/usr/local/.kairos/lease-%s", instance),
+		disableDHT: n.DisableDHT,
+		discovery:  n.Discovery,
+		vpn:        n.VPN,
+	}, nil
+}
+
 func SetupVPN(instance, apiAddress, rootDir string, start bool, c *providerConfig.Config) error {
-	token := ""
-	if c.P2P != nil && c.P2P.NetworkToken != "" {
-		token = c.P2P.NetworkToken
+	vpn, err := vpnInstanceFor(instance, apiAddress, c)
+	if err != nil {
+		return err
+	}
+
+	if err := vpn.vpn.Validate(); err != nil {
+		return err
 	}
 
+	if err := vpn.discovery.Validate(vpn.disableDHT); err != nil {
+		return err
+	}
+
+	envFile := filepath.Join(rootDir, services.EdgeVPNEnvFile(instance))
+
 	svc, err := services.EdgeVPN(instance, rootDir)
 	if err != nil {
 		return fmt.Errorf("could not create svc: %w", err)
 	}
 
-	apiAddress = strings.ReplaceAll(apiAddress, "https://", "")
+	apiAddress = strings.ReplaceAll(vpn.apiAddress, "https://", "")
 	apiAddress = strings.ReplaceAll(apiAddress, "http://", "")
 
 	vpnOpts := map[string]string{
 		"API":          "true",
 		"APILISTEN":    apiAddress,
 		"DHCP":         "true",
-		"DHCPLEASEDIR": "/usr/local/.kairos/lease",
+		"DHCPLEASEDIR": vpn.leaseDir,
 	}
-	if token != "" {
-		vpnOpts["EDGEVPNTOKEN"] = c.P2P.NetworkToken
+	if vpn.token != "" {
+		vpnOpts["EDGEVPNTOKEN"] = vpn.token
 	}
 
-	if c.P2P.DisableDHT {
-		vpnOpts["EDGEVPNDHT"] = "false"
+	if vpn.iface != "" {
+		vpnOpts["IFACE"] = vpn.iface
 	}
 
-	// Override opts with user-supplied
-	for k, v := range c.P2P.VPN.Env {
+	if !vpn.vpn.UsesDHCP() {
+		address, err := vpnAddress(envFile, vpn.vpn)
+		if err != nil {
+			return err
+		}
+		vpnOpts["DHCP"] = "false"
+		vpnOpts["ADDRESS"] = address
+	}
+
+	for k, v := range discoveryEnv(vpn.discovery, vpn.disableDHT) {
 		vpnOpts[k] = v
 	}
 
-	if c.P2P.DNS {
-		vpnOpts["DNSADDRESS"] = "127.0.0.1:53"
+	// DNS is served by the cluster network only
+	if instance == services.EdgeVPNDefaultInstance && c.P2P != nil && c.P2P.DNS.IsEnabled() {
+		dns := c.P2P.DNS
+		if err := dns.Validate(); err != nil {
+			return err
+		}
+
+		vpnOpts["DNSADDRESS"] = dns.ListenAddress()
 		vpnOpts["DNSFORWARD"] = "true"
+		if len(dns.Forwarders) > 0 {
+			vpnOpts["DNSFORWARDSERVER"] = strings.Join(dns.Forwarders, ",")
+		}
+		if dns.CacheSize > 0 {
+			vpnOpts["DNSCACHESIZE"] = strconv.Itoa(dns.CacheSize)
+		}
 
-		_ = machine.ExecuteInlineCloudConfig(assets.LocalDNS, "initramfs")
+		dnsConfig := assets.LocalDNS(dns.Nameserver(), dns.SearchDomain)
+		_ = machine.ExecuteInlineCloudConfig(dnsConfig, "initramfs")
 		if !utils.IsOpenRCBased() {
 			svc, err := systemd.NewService(
 				systemd.WithName("systemd-resolved"),
@@ -116,14 +215,19 @@ func SetupVPN(instance, apiAddress, rootDir string, start bool, c *providerConfi
 			}
 		}
 
-		if err := SaveCloudConfig("vpn_dns", []byte(assets.LocalDNS)); err != nil {
+		if err := SaveCloudConfig("vpn_dns", []byte(dnsConfig)); err != nil {
 			return fmt.Errorf("could not create dns config: %w", err)
 		}
 	}
 
+	// Override opts with user-supplied
+	for k, v := range vpn.vpn.Env {
+		vpnOpts[k] = v
+	}
+
 	os.MkdirAll("/etc/systemd/system.conf.d/", 0600) //nolint:errcheck
 	// Setup edgevpn instance
-	err = utils.WriteEnv(filepath.Join(rootDir, "/etc/systemd/system.conf.d/edgevpn-kairos.env"), vpnOpts)
+	err = utils.WriteEnv(envFile, vpnOpts)
 	if err != nil {
 		return fmt.Errorf("could not create write env file: %w", err)
 	}
@@ -143,3 +247,37 @@ func SetupVPN(instance, apiAddress, rootDir string, start bool, c *providerConfi
 	}
 	return nil
 }
+
+// vpnAddress returns the static VPN address, or the one derived from the address pool.
+// An address from the pool already in use is kept, as it might have been moved
+// away from the derived one to solve a conflict with another node.
+func vpnAddress(envFile string, vpn providerConfig.VPN) (string, error) {
+	if vpn.Address != "" {
+		return vpn.Address, nil
+	}
+
+	env, _ := godotenv.Read(envFile)
+	if current := env["ADDRESS"]; current != "" && env["DHCP"] == "false" && role.InPool(vpn.AddressPool, current) {
+		return current, nil
+	}
+
+	return role.PoolAddress(vpn.AddressPool, machine.UUID(), nil)
+}
+
+// SetupNetworks sets up an edgevpn instance for each additional P2P network.
+func SetupNetworks(rootDir string, start bool, c *providerConfig.Config) error {
+	if c.P2P == nil {
+		return nil
+	}
+
+	if err := c.P2P.ValidateNetworks(services.EdgeVPNDefaultInstance); err != nil {
+		return err
+	}
+
+	for _, n := range c.P2P.Networks {
+		if err := SetupVPN(n.Name, "", rootDir, start, c); err != nil {
+			return fmt.Errorf("could not setup p2p network '%s': %w", n.Name, err)
+		}
+	}
+	return nil
+}
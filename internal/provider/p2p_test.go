@@ -0,0 +1,111 @@
+package provider
+
+import (
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/provider-kairos/v2/internal/operator"
+	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("P2P DNS", func() {
+	It("accepts the boolean form", func() {
+		c := &providerConfig.Config{}
+		Expect(config.FromString("p2p:\n  dns: true\n", c)).To(Succeed())
+		Expect(c.P2P.DNS.IsEnabled()).To(BeTrue())
+		Expect(c.P2P.DNS.ListenAddress()).To(Equal("127.0.0.1:53"))
+		Expect(persistentRoles(c)).To(Equal("auto,node/info,token/rotation,dns/records"))
+
+		c = &providerConfig.Config{}
+		Expect(config.FromString("p2p:\n  dns: false\n", c)).To(Succeed())
+		Expect(c.P2P.DNS.IsEnabled()).To(BeFalse())
+		Expect(persistentRoles(c)).To(Equal("auto,node/info,token/rotation"))
+	})
+
+	It("enables DNS when the block is set", func() {
+		c := &providerConfig.Config{}
+		Expect(config.FromString(`p2p:
+  dns:
+    listen: 10.1.0.1:5353
+    forwarders: ["1.1.1.1:53", "8.8.8.8:53"]
+    cache_size: 500
+    search_domain: kairos
+    records: false
+`, c)).To(Succeed())
+		Expect(c.P2P.DNS.IsEnabled()).To(BeTrue())
+		Expect(c.P2P.DNS.Validate()).To(Succeed())
+		Expect(c.P2P.DNS.Nameserver()).To(Equal("10.1.0.1"))
+		Expect(c.P2P.DNS.Forwarders).To(Equal([]string{"1.1.1.1:53", "8.8.8.8:53"}))
+		Expect(c.P2P.DNS.CacheSize).To(Equal(500))
+		Expect(persistentRoles(c)).To(Equal("auto,node/info,token/rotation"))
+
+		c = &providerConfig.Config{}
+		Expect(config.FromString("p2p:\n  dns:\n    enable: false\n    forwarders: [\"1.1.1.1\"]\n", c)).To(Succeed())
+		Expect(c.P2P.DNS.IsEnabled()).To(BeFalse())
+		Expect(c.P2P.DNS.Validate()).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("P2P node IP", func() {
+	It("requires a valid CIDR", func() {
+		Expect(providerConfig.P2P{NodeIPCIDR: "10.0.0.0/24"}.Validate()).To(Succeed())
+		Expect(providerConfig.P2P{NodeIPCIDR: "10.0.0.0"}.Validate()).To(MatchError("invalid p2p.node_ip_cidr '10.0.0.0'"))
+	})
+})
+
+var _ = Describe("P2P master change debounce", func() {
+	It("requires a positive duration", func() {
+		Expect(providerConfig.P2P{MasterChangeDebounce: "30s"}.Validate()).To(Succeed())
+		Expect(providerConfig.P2P{MasterChangeDebounce: "-1m"}.Validate()).To(MatchError(ContainSubstring("p2p.master_change_debounce")))
+		Expect(providerConfig.P2P{MasterChangeDebounce: "soon"}.Validate()).To(MatchError(ContainSubstring("p2p.master_change_debounce")))
+	})
+})
+
+var _ = Describe("Pairing settings", func() {
+	It("requires trusted keys to require encryption", func() {
+		_, pub, err := operator.GenerateKey()
+		Expect(err).ToNot(HaveOccurred())
+		c := providerConfig.Config{Pairing: providerConfig.Pairing{RequireEncryption: true}}
+		Expect(c.Validate()).To(MatchError("pairing.require_encryption requires pairing.trusted_keys"))
+		c.Pairing.TrustedKeys = []string{pub}
+		Expect(c.Validate()).To(Succeed())
+		c.Pairing.TrustedKeys = []string{"Zm9v"}
+		Expect(c.Validate()).To(MatchError(ContainSubstring("invalid pairing.trusted_keys")))
+	})
+})
+
+var _ = Describe("P2P discovery", func() {
+	const peer = "/ip4/10.0.0.1/tcp/4001/p2p/12D3KooWJWZmhL3P5Lz4vw9qVPKPVmKvdBjGVjXU8rG6UgG6t8Uq"
+
+	It("renders bootstrap peers with static relays", func() {
+		d := providerConfig.Discovery{
+			BootstrapPeers:   []string{peer},
+			Relays:           []string{peer},
+			StaticRelaysOnly: true,
+		}
+		Expect(d.Validate(false)).To(Succeed())
+		Expect(discoveryEnv(d, false)).To(Equal(map[string]string{
+			"EDGEVPNBOOTSTRAPPEERS":      peer,
+			"EDGEVPNAUTORELAY":           "true",
+			"EDGEVPNAUTORELAYPEERS":      peer,
+			"EDGEVPNAUTORELAYSTATICONLY": "true",
+		}))
+	})
+
+	It("renders mDNS only discovery", func() {
+		d := providerConfig.Discovery{MDNSOnly: true}
+		Expect(d.Validate(true)).To(Succeed())
+		Expect(discoveryEnv(d, true)).To(Equal(map[string]string{
+			"EDGEVPNDHT":  "false",
+			"EDGEVPNMDNS": "true",
+		}))
+	})
+
+	It("rejects invalid settings", func() {
+		Expect(providerConfig.Discovery{BootstrapPeers: []string{"10.0.0.1:4001"}}.Validate(false)).ToNot(Succeed())
+		Expect(providerConfig.Discovery{BootstrapPeers: []string{"/ip4/10.0.0.1/tcp/4001"}}.Validate(false)).ToNot(Succeed())
+		Expect(providerConfig.Discovery{BootstrapPeers: []string{peer}}.Validate(true)).ToNot(Succeed())
+		Expect(providerConfig.Discovery{BootstrapPeers: []string{peer}, MDNSOnly: true}.Validate(false)).ToNot(Succeed())
+		Expect(providerConfig.Discovery{StaticRelaysOnly: true}.Validate(false)).ToNot(Succeed())
+	})
+})
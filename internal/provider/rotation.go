@@ -0,0 +1,75 @@
+package provider
+
+import (
+	"time"
+
+	"github.com/kairos-io/kairos-sdk/machine"
+	"github.com/kairos-io/provider-kairos/v2/internal/cluster"
+	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
+	"github.com/kairos-io/provider-kairos/v2/internal/role"
+	"github.com/kairos-io/provider-kairos/v2/internal/services"
+
+	service "github.com/mudler/edgevpn/api/client/service"
+)
+
+// tokenConfigDirs are the writable directories where the network token is replaced.
+var tokenConfigDirs = []string{"/oem", "/usr/local/cloud-config", "/etc/kairos"}
+
+// rotateNodeToken replaces the network token of the node and restarts the
+// edgevpn service it runs, either the VPN or the API only.
+func rotateNodeToken(configDir []string, token, apiAddress, rootDir string) error {
+	if err := ReplaceToken(configDir, token); err != nil {
+		return err
+	}
+
+	c, err := scanConfig(configDir)
+	if err != nil {
+		return err
+	}
+
+	var svc machine.Service
+	if c.P2P != nil && c.P2P.VPNNeedsCreation() {
+		if err := SetupVPN(services.EdgeVPNDefaultInstance, apiAddress, rootDir, false, c); err != nil {
+			return err
+		}
+		svc, err = services.EdgeVPN(services.EdgeVPNDefaultInstance, rootDir)
+	} else {
+		if err := SetupAPI(apiAddress, rootDir, false, c); err != nil {
+			return err
+		}
+		svc, err = services.P2PAPI(rootDir)
+	}
+	if err != nil {
+		return err
+	}
+	return svc.Restart()
+}
+
+// tokenRotation applies the token rotation published in the ledger once its time
+// comes, so that all the nodes switch network together. Only rotations signed with
+// one of the p2p.token_rotation.trusted_keys are applied.
+func tokenRotation(pconfig *providerConfig.Config, apiAddress string) role.Role {
+	current := pconfig.P2P.NetworkToken
+	return func(c *service.RoleConfig) error {
+		r, err := cluster.GetTokenRotation(c.Client)
+		if err != nil || r == nil || r.Token == current {
+			return err
+		}
+		if err := r.Verify(pconfig.P2P.TokenRotation.TrustedKeys); err != nil {
+			c.Logger.Warnf("Ignoring the token rotation: %s", err.Error())
+			return nil
+		}
+
+		if !r.Due(time.Now()) {
+			c.Logger.Debugf("Token rotation scheduled at %s", r.At.Local().Format(time.RFC3339))
+			return nil
+		}
+
+		c.Logger.Info("Rotating network token")
+		if err := rotateNodeToken(tokenConfigDirs, r.Token, apiAddress, "/"); err != nil {
+			return err
+		}
+		current = r.Token
+		return nil
+	}
+}
@@ -0,0 +1,370 @@
+package role
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
+	"github.com/samber/lo"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+
+	service "github.com/mudler/edgevpn/api/client/service"
+)
+
+const (
+	// IdentityBucket holds the identity claim published by every node, keyed by UUID.
+	IdentityBucket = "identity"
+	// AdmissionBucket holds the approval decisions, keyed by UUID.
+	AdmissionBucket = "admission"
+	// NodeTokenBucket holds the token to join the cluster, keyed by UUID when encrypted to the nodes.
+	NodeTokenBucket = "nodetoken"
+
+	admissionDenied   = "denied"
+	admissionApproved = "approved"
+)
+
+// IdentityFile is the private key identifying the node, generated on first boot.
+var IdentityFile = "/usr/local/.kairos/identity.key"
+
+// LoadIdentity reads the ed25519 identity key of the node, generating it if it doesn't exist.
+func LoadIdentity(path string) (ed25519.PrivateKey, error) {
+	dat, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(dat)
+		if block == nil {
+			return nil, fmt.Errorf("invalid identity key %s", path)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity key %s: %w", path, err)
+		}
+		priv, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("identity key %s is not ed25519", path)
+		}
+		return priv, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
+
+// Fingerprint returns the printable fingerprint of a public key.
+func Fingerprint(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// identityValidity is how long a published identity claim is valid, as long as the
+// advertisement of nodes in the ledger. Nodes sign a fresh one every identityRefresh,
+// so that the claim of a node which left the network can't be reused.
+const (
+	identityValidity = 15 * time.Minute
+	identityRefresh  = 5 * time.Minute
+)
+
+// boxKey derives the key the secrets shared with the node are encrypted to from its identity.
+func boxKey(key ed25519.PrivateKey) (*[32]byte, *[32]byte) {
+	priv := sha256.Sum256(append([]byte("kairos-identity-box\n"), key.Seed()...))
+	pub, _ := curve25519.X25519(priv[:], curve25519.Basepoint)
+	var public [32]byte
+	copy(public[:], pub)
+	return &public, &priv
+}
+
+func identityMessage(uuid string, box *[32]byte, at int64) []byte {
+	return []byte(fmt.Sprintf("kairos-identity-v1\n%s\n%s\n%d", uuid, base64.StdEncoding.EncodeToString(box[:]), at))
+}
+
+// IdentityClaim returns the public keys of the node, signed along with the UUID and the
+// time of the claim. It binds the UUID announced on the network to the identity key.
+func IdentityClaim(key ed25519.PrivateKey, uuid string, at time.Time) string {
+	pub := key.Public().(ed25519.PublicKey)
+	box, _ := boxKey(key)
+	return fmt.Sprintf("%s.%s.%d.%s",
+		base64.StdEncoding.EncodeToString(pub),
+		base64.StdEncoding.EncodeToString(box[:]),
+		at.Unix(),
+		base64.StdEncoding.EncodeToString(ed25519.Sign(key, identityMessage(uuid, box, at.Unix()))))
+}
+
+// nodeIdentity is a verified identity claim.
+type nodeIdentity struct {
+	fingerprint string
+	box         *[32]byte
+	at          time.Time
+}
+
+func verifyIdentity(uuid, claim string, now time.Time) (nodeIdentity, error) {
+	if claim == "" {
+		return nodeIdentity{}, errors.New("no identity published")
+	}
+	parts := strings.Split(claim, ".")
+	if len(parts) != 4 {
+		return nodeIdentity{}, errors.New("malformed identity")
+	}
+	pub, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nodeIdentity{}, errors.New("malformed identity public key")
+	}
+	box, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(box) != 32 {
+		return nodeIdentity{}, errors.New("malformed identity encryption key")
+	}
+	at, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nodeIdentity{}, errors.New("malformed identity time")
+	}
+	sig, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nodeIdentity{}, errors.New("malformed identity signature")
+	}
+	id := nodeIdentity{fingerprint: Fingerprint(pub), box: &[32]byte{}, at: time.Unix(at, 0)}
+	copy(id.box[:], box)
+	if !ed25519.Verify(pub, identityMessage(uuid, id.box, at), sig) {
+		return nodeIdentity{}, fmt.Errorf("identity signature doesn't match node %s", uuid)
+	}
+	if now.Sub(id.at) > identityValidity || id.at.Sub(now) > identityValidity {
+		return nodeIdentity{}, fmt.Errorf("identity of node %s expired", uuid)
+	}
+	return id, nil
+}
+
+// VerifyIdentity checks the identity claim of a node and returns the fingerprint of its key.
+func VerifyIdentity(uuid, claim string) (string, error) {
+	id, err := verifyIdentity(uuid, claim, time.Now())
+	return id.fingerprint, err
+}
+
+// decisionMessage binds a decision to the node and, for approvals, to its identity key.
+func decisionMessage(verdict, uuid, fingerprint string) []byte {
+	return []byte(fmt.Sprintf("kairos-admission-v1\n%s\n%s\n%s", verdict, uuid, fingerprint))
+}
+
+// signDecision returns the verdict signed with the operator key, as verdict:publickey.signature.
+func signDecision(key ed25519.PrivateKey, verdict, uuid, fingerprint string) string {
+	return fmt.Sprintf("%s:%s.%s", verdict,
+		base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+		base64.StdEncoding.EncodeToString(ed25519.Sign(key, decisionMessage(verdict, uuid, fingerprint))))
+}
+
+// Approval returns the admission decision approving the key with the given fingerprint,
+// signed with the operator key.
+func Approval(key ed25519.PrivateKey, uuid, fingerprint string) string {
+	return signDecision(key, admissionApproved, uuid, fingerprint)
+}
+
+// Denial returns the admission decision denying a node, signed with the operator key.
+func Denial(key ed25519.PrivateKey, uuid string) string {
+	return signDecision(key, admissionDenied, uuid, "")
+}
+
+// decisionVerdict returns the verdict of a correctly signed decision and the public key
+// which signed it. Whether the key is trusted is up to the caller.
+func decisionVerdict(decision, uuid, fingerprint string) (string, string) {
+	verdict, signed, _ := strings.Cut(decision, ":")
+	pub, sig, _ := strings.Cut(signed, ".")
+	if verdict == admissionDenied {
+		fingerprint = ""
+	} else if verdict != admissionApproved {
+		return "", ""
+	}
+	pubKey, err := base64.StdEncoding.DecodeString(pub)
+	if err != nil || len(pubKey) != ed25519.PublicKeySize {
+		return "", ""
+	}
+	signature, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil || !ed25519.Verify(pubKey, decisionMessage(verdict, uuid, fingerprint), signature) {
+		return "", ""
+	}
+	return verdict, pub
+}
+
+// admitted decides on a node given its identity claim, the admission decision in the ledger
+// and the settings. Decisions count only when signed by a trusted key, as any node can write
+// to the ledger. The allowlist holds UUIDs or key fingerprints.
+func admitted(uuid, claim, decision string, admission providerConfig.Admission) bool {
+	fingerprint, err := VerifyIdentity(uuid, claim)
+	if err != nil {
+		return false
+	}
+	verdict, signer := decisionVerdict(decision, uuid, fingerprint)
+	trusted := signer != "" && lo.Contains(admission.TrustedKeys, signer)
+	if trusted && verdict == admissionDenied {
+		return false
+	}
+	if lo.Contains(admission.Allowlist, uuid) || lo.Contains(admission.Allowlist, fingerprint) {
+		return true
+	}
+	return trusted && verdict == admissionApproved
+}
+
+// Admitted reports whether the node can take part in role scheduling.
+func Admitted(client *service.Client, pconfig *providerConfig.Config, uuid string) bool {
+	if !pconfig.P2P.Admission.Enable {
+		return true
+	}
+	claim, _ := client.Get(IdentityBucket, uuid)
+	decision, _ := client.Get(AdmissionBucket, uuid)
+	return admitted(uuid, claim, decision, pconfig.P2P.Admission)
+}
+
+// AdmittedNodes filters out the nodes which are not admitted.
+func AdmittedNodes(client *service.Client, pconfig *providerConfig.Config, nodes []string) []string {
+	if !pconfig.P2P.Admission.Enable {
+		return nodes
+	}
+	return lo.Filter(nodes, func(n string, _ int) bool {
+		return Admitted(client, pconfig, n)
+	})
+}
+
+// AdmittedMaster reports whether an admitted node holds the role publishing the master data.
+func AdmittedMaster(client *service.Client, pconfig *providerConfig.Config) bool {
+	if !pconfig.P2P.Admission.Enable {
+		return true
+	}
+	nodes, _ := client.AdvertizingNodes()
+	for _, n := range nodes {
+		r, _ := client.Get("role", n)
+		if (r == "master" || r == "master/clusterinit") && Admitted(client, pconfig, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// PendingNodes returns the fingerprints of the nodes with a valid identity and no signed decision
+// for it yet, keyed by UUID.
+func PendingNodes(client *service.Client, nodes []string) map[string]string {
+	pending := map[string]string{}
+	for _, n := range nodes {
+		claim, _ := client.Get(IdentityBucket, n)
+		fingerprint, err := VerifyIdentity(n, claim)
+		if err != nil {
+			continue
+		}
+		decision, _ := client.Get(AdmissionBucket, n)
+		if verdict, _ := decisionVerdict(decision, n, fingerprint); verdict == "" {
+			pending[n] = fingerprint
+		}
+	}
+	return pending
+}
+
+// Identity publishes the identity claim of the node, renewing it before it expires.
+func Identity(key ed25519.PrivateKey) Role { //nolint:revive
+	return func(c *service.RoleConfig) error {
+		// Nodes without admission have no identity key
+		if key == nil {
+			return nil
+		}
+		now := time.Now()
+		published, _ := c.Client.Get(IdentityBucket, c.UUID)
+		if id, err := verifyIdentity(c.UUID, published, now); err == nil &&
+			id.fingerprint == Fingerprint(key.Public().(ed25519.PublicKey)) && now.Sub(id.at) < identityRefresh {
+			return nil
+		}
+		c.Logger.Infof("Publishing node identity %s", Fingerprint(key.Public().(ed25519.PublicKey)))
+		return c.Client.Set(IdentityBucket, c.UUID, IdentityClaim(key, c.UUID, now))
+	}
+}
+
+// sealedTag identifies the key and the token a sealed token was encrypted for,
+// so that it is only encrypted again when one of them changes.
+func sealedTag(fingerprint, token string) string {
+	sum := sha256.Sum256([]byte(fingerprint + "\n" + token))
+	return base64.RawStdEncoding.EncodeToString(sum[:16])
+}
+
+// PublishNodeToken publishes the token nodes join the cluster with. With admission, the token is
+// encrypted to the identity of every admitted node instead, so that it can't be read from the ledger
+// by the nodes which are not admitted, or by the ones which copied the identity claim of another.
+func PublishNodeToken(c *service.RoleConfig, pconfig *providerConfig.Config, token string) error {
+	if !pconfig.P2P.Admission.Enable {
+		return c.Client.Set(NodeTokenBucket, "token", token)
+	}
+
+	nodes, _ := c.Client.AdvertizingNodes()
+	now := time.Now()
+	for _, n := range AdmittedNodes(c.Client, pconfig, nodes) {
+		claim, _ := c.Client.Get(IdentityBucket, n)
+		id, err := verifyIdentity(n, claim, now)
+		if err != nil {
+			continue
+		}
+		tag := sealedTag(id.fingerprint, token)
+		if sealed, _ := c.Client.Get(NodeTokenBucket, n); strings.HasPrefix(sealed, tag+".") {
+			continue
+		}
+		ciphertext, err := box.SealAnonymous(nil, []byte(token), id.box, rand.Reader)
+		if err != nil {
+			return err
+		}
+		if err := c.Client.Set(NodeTokenBucket, n, tag+"."+base64.StdEncoding.EncodeToString(ciphertext)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NodeToken returns the token published by the masters to join the cluster, if any.
+// With admission, it is decrypted with the identity key of the node.
+func NodeToken(c *service.RoleConfig, pconfig *providerConfig.Config) (string, error) {
+	if !pconfig.P2P.Admission.Enable {
+		token, _ := c.Client.Get(NodeTokenBucket, "token")
+		return token, nil
+	}
+
+	sealed, _ := c.Client.Get(NodeTokenBucket, c.UUID)
+	if sealed == "" {
+		return "", nil
+	}
+	key, err := LoadIdentity(IdentityFile)
+	if err != nil {
+		return "", err
+	}
+	return openNodeToken(key, sealed)
+}
+
+func openNodeToken(key ed25519.PrivateKey, sealed string) (string, error) {
+	_, ciphertext, _ := strings.Cut(sealed, ".")
+	dat, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", errors.New("malformed node token")
+	}
+	pub, priv := boxKey(key)
+	token, ok := box.OpenAnonymous(nil, dat, pub, priv)
+	if !ok {
+		return "", errors.New("node token is not encrypted to the node identity")
+	}
+	return string(token), nil
+}
@@ -0,0 +1,106 @@
+package role
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"time"
+
+	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
+	"golang.org/x/crypto/nacl/box"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Admission", func() {
+	var key ed25519.PrivateKey
+
+	BeforeEach(func() {
+		dir, err := os.MkdirTemp("", "identity")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+
+		path := filepath.Join(dir, "state", "identity.key")
+		key, err = LoadIdentity(path)
+		Expect(err).ToNot(HaveOccurred())
+
+		info, err := os.Stat(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+
+		again, err := LoadIdentity(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(again.Equal(key)).To(BeTrue())
+	})
+
+	It("binds the identity to the node UUID", func() {
+		claim := IdentityClaim(key, "node-a", time.Now())
+
+		fingerprint, err := VerifyIdentity("node-a", claim)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fingerprint).To(Equal(Fingerprint(key.Public().(ed25519.PublicKey))))
+
+		_, err = VerifyIdentity("node-b", claim)
+		Expect(err).To(HaveOccurred())
+		_, err = VerifyIdentity("node-a", "")
+		Expect(err).To(HaveOccurred())
+		_, err = VerifyIdentity("node-a", "garbage")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("expires the identity claims", func() {
+		_, err := VerifyIdentity("node-a", IdentityClaim(key, "node-a", time.Now().Add(-time.Hour)))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("admits nodes approved with a trusted key and allowlisted nodes only", func() {
+		claim := IdentityClaim(key, "node-a", time.Now())
+		fingerprint, _ := VerifyIdentity("node-a", claim)
+
+		_, operator, err := ed25519.GenerateKey(nil)
+		Expect(err).ToNot(HaveOccurred())
+		_, other, err := ed25519.GenerateKey(nil)
+		Expect(err).ToNot(HaveOccurred())
+		trusted := providerConfig.Admission{TrustedKeys: []string{base64.StdEncoding.EncodeToString(operator.Public().(ed25519.PublicKey))}}
+		allow := func(l ...string) providerConfig.Admission {
+			return providerConfig.Admission{TrustedKeys: trusted.TrustedKeys, Allowlist: l}
+		}
+
+		Expect(admitted("node-a", claim, "", trusted)).To(BeFalse())
+		Expect(admitted("node-a", claim, Approval(operator, "node-a", fingerprint), trusted)).To(BeTrue())
+		Expect(admitted("node-a", claim, Approval(operator, "node-a", "SHA256:other"), trusted)).To(BeFalse())
+		Expect(admitted("node-a", claim, Approval(operator, "node-b", fingerprint), trusted)).To(BeFalse())
+		Expect(admitted("node-a", claim, "approved:"+fingerprint, trusted)).To(BeFalse())
+		// A node can sign its own approval, but its key isn't trusted
+		Expect(admitted("node-a", claim, Approval(key, "node-a", fingerprint), trusted)).To(BeFalse())
+		Expect(admitted("node-a", claim, Approval(other, "node-a", fingerprint), trusted)).To(BeFalse())
+
+		Expect(admitted("node-a", claim, Denial(operator, "node-a"), allow("node-a"))).To(BeFalse())
+		Expect(admitted("node-a", claim, Denial(other, "node-a"), allow("node-a"))).To(BeTrue())
+		Expect(admitted("node-a", claim, "denied", allow("node-a"))).To(BeTrue())
+		Expect(admitted("node-a", claim, "", allow("node-a"))).To(BeTrue())
+		Expect(admitted("node-a", claim, "", allow(fingerprint))).To(BeTrue())
+		Expect(admitted("node-a", "", "", allow("node-a"))).To(BeFalse())
+	})
+
+	It("encrypts the node token to the node identity only", func() {
+		id, err := verifyIdentity("node-a", IdentityClaim(key, "node-a", time.Now()), time.Now())
+		Expect(err).ToNot(HaveOccurred())
+
+		ciphertext, err := box.SealAnonymous(nil, []byte("K10token"), id.box, rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		sealed := sealedTag(id.fingerprint, "K10token") + "." + base64.StdEncoding.EncodeToString(ciphertext)
+
+		token, err := openNodeToken(key, sealed)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(token).To(Equal("K10token"))
+
+		_, other, err := ed25519.GenerateKey(nil)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = openNodeToken(other, sealed)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -2,6 +2,7 @@ package role
 
 import (
 	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/provider-kairos/v2/internal/metrics"
 
 	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
 	utils "github.com/mudler/edgevpn/pkg/utils"
@@ -20,9 +21,17 @@ func contains(slice []string, elem string) bool {
 
 func Auto(cc *config.Config, pconfig *providerConfig.Config) Role { //nolint:revive
 	return func(c *service.RoleConfig) error {
+		if !Admitted(c.Client, pconfig, c.UUID) {
+			c.Logger.Infof("<%s> not admitted to the network yet, waiting for approval", c.UUID)
+			return nil
+		}
+
 		advertizing, _ := c.Client.AdvertizingNodes()
 		actives, _ := c.Client.ActiveNodes()
 
+		// Unapproved nodes can't be elected nor get a role
+		advertizing = AdmittedNodes(c.Client, pconfig, advertizing)
+
 		minimumNodes := pconfig.P2P.MinimumNodes
 		if minimumNodes == 0 {
 			minimumNodes = 2
@@ -51,6 +60,7 @@ func Auto(cc *config.Config, pconfig *providerConfig.Config) Role { //nolint:rev
 
 		if shouldBeLeader == c.UUID && (lead == "" || !contains(nodes, lead)) {
 			if err := c.Client.Set("auto", "leader", c.UUID); err != nil {
+				metrics.LedgerError("set")
 				c.Logger.Error(err)
 				return err
 			}
@@ -1,25 +1,216 @@
 package role
 
 import (
+	"bufio"
 	"fmt"
 	"net"
+	"os"
+	"strings"
 
 	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
+	"github.com/kairos-io/provider-kairos/v2/internal/role"
+
+	service "github.com/mudler/edgevpn/api/client/service"
 )
 
-func guessInterface(pconfig *providerConfig.Config) string {
-	if pconfig.KubeVIP.Interface != "" {
-		return pconfig.KubeVIP.Interface
+// virtualInterfacePrefixes are interfaces created by container runtimes, CNIs,
+// hypervisors and VPNs, which never carry the node address.
+var virtualInterfacePrefixes = []string{
+	"lo", "docker", "cni", "flannel", "veth", "virbr", "vxlan", "kube-ipvs", "cali", "cilium",
+	"weave", "tun", "tap", "br-", "edgevpn", "kube-bridge", "nodelocaldns", "vnet",
+}
+
+type netInterface struct {
+	Name     string
+	Up       bool
+	Loopback bool
+	Addrs    []net.IP
+}
+
+func isVirtualInterface(name string) bool {
+	for _, p := range virtualInterfacePrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeIP returns the preferred address of an interface: a global unicast IPv4,
+// then a global unicast IPv6. If cidr is given, only addresses within it are considered.
+func (i netInterface) nodeIP(cidr *net.IPNet) string {
+	var v6 string
+	for _, ip := range i.Addrs {
+		if !ip.IsGlobalUnicast() || (cidr != nil && !cidr.Contains(ip)) {
+			continue
+		}
+		if ip.To4() != nil {
+			return ip.String()
+		}
+		if v6 == "" {
+			v6 = ip.String()
+		}
+	}
+	return v6
+}
+
+// selectInterface picks the interface and address the node should use for Kubernetes.
+// The strategy is, in order: the configured override, an interface with an address within
+// the configured CIDR, the default route interface, and the first interface which is up,
+// not virtual and has a global unicast address.
+func selectInterface(ifaces []netInterface, override, defaultRoute string, cidr *net.IPNet) (string, string) {
+	if override != "" {
+		for _, i := range ifaces {
+			if i.Name == override {
+				return i.Name, i.nodeIP(cidr)
+			}
+		}
+		return override, ""
+	}
+
+	if cidr != nil {
+		for _, i := range ifaces {
+			if ip := i.nodeIP(cidr); i.Up && ip != "" {
+				return i.Name, ip
+			}
+		}
+	}
+
+	if defaultRoute != "" {
+		for _, i := range ifaces {
+			if ip := i.nodeIP(cidr); i.Name == defaultRoute && i.Up && ip != "" {
+				return i.Name, ip
+			}
+		}
 	}
+
+	for _, i := range ifaces {
+		if !i.Up || i.Loopback || isVirtualInterface(i.Name) {
+			continue
+		}
+		if ip := i.nodeIP(cidr); ip != "" {
+			return i.Name, ip
+		}
+	}
+
+	return "", ""
+}
+
+func systemInterfaces() []netInterface {
 	ifaces, err := net.Interfaces()
 	if err != nil {
-		fmt.Println("failed getting system interfaces")
-		return ""
+		return nil
 	}
+
+	res := []netInterface{}
 	for _, i := range ifaces {
-		if i.Name != "lo" {
-			return i.Name
+		ni := netInterface{
+			Name:     i.Name,
+			Up:       i.Flags&net.FlagUp != 0,
+			Loopback: i.Flags&net.FlagLoopback != 0,
+		}
+		addrs, _ := i.Addrs()
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok {
+				ni.Addrs = append(ni.Addrs, ipNet.IP)
+			}
+		}
+		res = append(res, ni)
+	}
+	return res
+}
+
+// defaultRouteInterface returns the interface of the IPv4 default route, or of the IPv6 one.
+func defaultRouteInterface() string {
+	if iface := parseDefaultRoute("/proc/net/route", 0, 1, "00000000"); iface != "" {
+		return iface
+	}
+	return parseDefaultRoute("/proc/net/ipv6_route", 9, 0, "00000000000000000000000000000000")
+}
+
+func parseDefaultRoute(file string, ifaceField, destField int, defaultDest string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) <= ifaceField || len(fields) <= destField {
+			continue
+		}
+		if fields[destField] == defaultDest && fields[ifaceField] != "lo" {
+			return fields[ifaceField]
+		}
+	}
+	return ""
+}
+
+// nodeInterface returns the interface and IP used by Master, Worker and kube-vip
+// when the VPN is not used for Kubernetes.
+func nodeInterface(pconfig *providerConfig.Config) (string, string, error) {
+	var cidr *net.IPNet
+	if pconfig.P2P != nil && pconfig.P2P.NodeIPCIDR != "" {
+		var err error
+		if _, cidr, err = net.ParseCIDR(pconfig.P2P.NodeIPCIDR); err != nil {
+			return "", "", fmt.Errorf("invalid p2p.node_ip_cidr '%s'", pconfig.P2P.NodeIPCIDR)
+		}
+	}
+	iface, ip := selectInterface(systemInterfaces(), pconfig.KubeVIP.Interface, defaultRouteInterface(), cidr)
+	return iface, ip, nil
+}
+
+// VPNInterface returns the interface of the VPN used by the cluster.
+func VPNInterface(pconfig *providerConfig.Config) string {
+	if pconfig.P2P != nil && pconfig.P2P.VPN.Env["IFACE"] != "" {
+		return pconfig.P2P.VPN.Env["IFACE"]
+	}
+	return "edgevpn0"
+}
+
+// vpnIP returns the node address on the VPN. With a static address, it is
+// returned only once the interface has it assigned. With an address pool, only once
+// the address is settled, so that Kubernetes is not configured on an address
+// which is later moved away to solve a conflict with another node.
+func vpnIP(c *service.RoleConfig, pconfig *providerConfig.Config) string {
+	ip := interfaceIP(VPNInterface(pconfig))
+	if pconfig.P2P == nil || ip == "" {
+		return ip
+	}
+	if pconfig.P2P.VPN.Address != "" {
+		static, _, _ := net.ParseCIDR(pconfig.P2P.VPN.Address)
+		if static == nil || static.String() != ip {
+			return ""
+		}
+		return ip
+	}
+	if usesAddressPool(pconfig) && !role.VPNAddressSettled(c, ip) {
+		c.Logger.Infof("VPN address %s not settled yet", ip)
+		return ""
+	}
+	return ip
+}
+
+// usesAddressPool tells if the VPN address comes from the pool, and is therefore
+// managed by the vpn/address role.
+func usesAddressPool(pconfig *providerConfig.Config) bool {
+	return pconfig.P2P != nil && pconfig.P2P.VPNNeedsCreation() &&
+		pconfig.P2P.VPN.Address == "" && pconfig.P2P.VPN.AddressPool != ""
+}
+
+// interfaceIP returns the preferred address of the given interface.
+func interfaceIP(name string) string {
+	for _, i := range systemInterfaces() {
+		if i.Name == name {
+			return i.nodeIP(nil)
 		}
 	}
 	return ""
 }
+
+func guessInterface(pconfig *providerConfig.Config) (string, error) {
+	iface, _, err := nodeInterface(pconfig)
+	return iface, err
+}
@@ -0,0 +1,43 @@
+package role
+
+import (
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Interface detection", func() {
+	ifaces := []netInterface{
+		{Name: "lo", Up: true, Loopback: true, Addrs: []net.IP{net.ParseIP("127.0.0.1")}},
+		{Name: "docker0", Up: true, Addrs: []net.IP{net.ParseIP("172.17.0.1")}},
+		{Name: "eth0", Up: false, Addrs: []net.IP{net.ParseIP("192.168.0.5")}},
+		{Name: "eth1", Up: true, Addrs: []net.IP{net.ParseIP("fe80::1"), net.ParseIP("10.0.0.5")}},
+		{Name: "eth2", Up: true, Addrs: []net.IP{net.ParseIP("192.168.100.5")}},
+	}
+
+	It("honors the configured interface", func() {
+		iface, ip := selectInterface(ifaces, "eth2", "eth1", nil)
+		Expect(iface).To(Equal("eth2"))
+		Expect(ip).To(Equal("192.168.100.5"))
+	})
+
+	It("selects the interface with an address in the configured CIDR", func() {
+		_, cidr, _ := net.ParseCIDR("192.168.100.0/24")
+		iface, ip := selectInterface(ifaces, "", "eth1", cidr)
+		Expect(iface).To(Equal("eth2"))
+		Expect(ip).To(Equal("192.168.100.5"))
+	})
+
+	It("prefers the default route interface", func() {
+		iface, ip := selectInterface(ifaces, "", "eth2", nil)
+		Expect(iface).To(Equal("eth2"))
+		Expect(ip).To(Equal("192.168.100.5"))
+	})
+
+	It("skips virtual, down and loopback interfaces", func() {
+		iface, ip := selectInterface(ifaces, "", "", nil)
+		Expect(iface).To(Equal("eth1"))
+		Expect(ip).To(Equal("10.0.0.5"))
+	})
+})
@@ -0,0 +1,135 @@
+package role
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
+	"github.com/kairos-io/provider-kairos/v2/internal/role"
+
+	service "github.com/mudler/edgevpn/api/client/service"
+	"github.com/mudler/edgevpn/api/types"
+)
+
+var dnsClient = &http.Client{Timeout: 10 * time.Second}
+
+// dnsRegex returns the expression matching a fully qualified query for name.
+func dnsRegex(name string) string {
+	return fmt.Sprintf("(?i)^%s\\.?$", regexp.QuoteMeta(name))
+}
+
+// clusterRecords returns the A records of the cluster names known by the node,
+// keyed by name. Records whose address is not known yet are left out.
+func clusterRecords(networkID, hostname, nodeIP, masterIP, vip string) map[string]string {
+	records := map[string]string{}
+	if hostname != "" && nodeIP != "" {
+		records[fmt.Sprintf("%s.%s", strings.ToLower(hostname), networkID)] = nodeIP
+	}
+	if masterIP != "" {
+		records[fmt.Sprintf("master.%s", networkID)] = masterIP
+	}
+	api := vip
+	if api == "" {
+		api = masterIP
+	}
+	if api != "" {
+		records[fmt.Sprintf("api.%s", networkID)] = api
+	}
+	return records
+}
+
+func dnsURL(apiAddress string) string {
+	if !strings.Contains(apiAddress, "://") {
+		apiAddress = "http://" + apiAddress
+	}
+	return strings.TrimSuffix(apiAddress, "/") + "/api/dns"
+}
+
+// publishedRecords returns the A records currently in the ledger, keyed by regex.
+func publishedRecords(apiAddress string) (map[string]string, error) {
+	resp, err := dnsClient.Get(dnsURL(apiAddress))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	records := []types.DNS{}
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		return nil, err
+	}
+
+	res := map[string]string{}
+	for _, r := range records {
+		res[r.Regex] = r.Records["A"]
+	}
+	return res, nil
+}
+
+func publishRecord(apiAddress, name, ip string) error {
+	dat, err := json.Marshal(types.DNS{Regex: dnsRegex(name), Records: map[string]string{"A": ip}})
+	if err != nil {
+		return err
+	}
+	resp, err := dnsClient.Post(dnsURL(apiAddress), "application/json", bytes.NewReader(dat))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("publishing DNS record %s: %s", name, resp.Status)
+	}
+	return nil
+}
+
+// syncRecords publishes only the records which are missing or changed, as every
+// announce is kept alive by the ledger in the background.
+func syncRecords(apiAddress string, records map[string]string) ([]string, error) {
+	published, err := publishedRecords(apiAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := []string{}
+	for name, ip := range records {
+		if published[dnsRegex(name)] == ip {
+			continue
+		}
+		if err := publishRecord(apiAddress, name, ip); err != nil {
+			return updated, err
+		}
+		updated = append(updated, name)
+	}
+	return updated, nil
+}
+
+// DNSRecords publishes the <hostname>.<network-id>, master.<network-id> and
+// api.<network-id> records on the cluster DNS.
+func DNSRecords(pconfig *providerConfig.Config, networkID, apiAddress string) role.Role { //nolint:revive
+	return func(c *service.RoleConfig) error {
+		hostname, _ := os.Hostname()
+
+		var nodeIP string
+		if pconfig.P2P.UseVPNWithKubernetes() {
+			nodeIP = vpnIP(c, pconfig)
+		} else {
+			var err error
+			if _, nodeIP, err = nodeInterface(pconfig); err != nil {
+				return err
+			}
+		}
+
+		masterIP, _ := c.Client.Get("master", "ip")
+
+		updated, err := syncRecords(apiAddress, clusterRecords(networkID, hostname, nodeIP, masterIP, kubeVIPAddress(pconfig)))
+		for _, name := range updated {
+			c.Logger.Infof("Published DNS record %s", name)
+		}
+		return err
+	}
+}
@@ -0,0 +1,70 @@
+package role
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+
+	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
+	"github.com/mudler/edgevpn/api/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DNS records", func() {
+	It("names the node, master and api records after the network ID", func() {
+		Expect(clusterRecords("kairos", "Node-1", "10.1.0.2", "10.1.0.1", "")).To(Equal(map[string]string{
+			"node-1.kairos": "10.1.0.2",
+			"master.kairos": "10.1.0.1",
+			"api.kairos":    "10.1.0.1",
+		}))
+		Expect(clusterRecords("kairos", "node-1", "", "10.1.0.1", "192.168.1.100")).To(Equal(map[string]string{
+			"master.kairos": "10.1.0.1",
+			"api.kairos":    "192.168.1.100",
+		}))
+	})
+
+	It("matches fully qualified queries only for the exact name", func() {
+		r := regexp.MustCompile(dnsRegex("api.kairos"))
+		Expect(r.MatchString("api.kairos.")).To(BeTrue())
+		Expect(r.MatchString("API.kairos.")).To(BeTrue())
+		Expect(r.MatchString("apixkairos.")).To(BeFalse())
+		Expect(r.MatchString("foo.api.kairos.")).To(BeFalse())
+	})
+
+	It("publishes only missing or changed records", func() {
+		published := []types.DNS{
+			{Regex: dnsRegex("master.kairos"), Records: map[string]string{"A": "10.1.0.1"}},
+			{Regex: dnsRegex("api.kairos"), Records: map[string]string{"A": "10.1.0.5"}},
+		}
+		posted := []types.DNS{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.URL.Path).To(Equal("/api/dns"))
+			if r.Method == http.MethodPost {
+				d := types.DNS{}
+				Expect(json.NewDecoder(r.Body).Decode(&d)).To(Succeed())
+				posted = append(posted, d)
+			}
+			json.NewEncoder(w).Encode(published) //nolint:errcheck
+		}))
+		defer server.Close()
+
+		updated, err := syncRecords(server.URL, map[string]string{
+			"master.kairos": "10.1.0.1",
+			"api.kairos":    "10.1.0.1",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(updated).To(Equal([]string{"api.kairos"}))
+		Expect(posted).To(Equal([]types.DNS{{Regex: dnsRegex("api.kairos"), Records: map[string]string{"A": "10.1.0.1"}}}))
+	})
+
+	It("adds the api name to the k3s certificate", func() {
+		enabled := true
+		c := &providerConfig.Config{P2P: &providerConfig.P2P{DNS: providerConfig.DNS{Enable: &enabled}}}
+		Expect(genArgs(c, "kairos", "10.1.0.1", "10.1.0.1")).To(ContainElement("--tls-san=api.kairos"))
+
+		c.P2P.DNS = providerConfig.DNS{}
+		Expect(genArgs(c, "kairos", "10.1.0.1", "10.1.0.1")).ToNot(ContainElement("--tls-san=api.kairos"))
+	})
+})
@@ -1,50 +1,330 @@
 package role
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
 
-	"github.com/kairos-io/kairos-sdk/utils"
+	"github.com/ipfs/go-log/v2"
 	"github.com/kairos-io/provider-kairos/v2/internal/assets"
 	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
 )
 
-func generateKubeVIP(command string, iface, ip string, args []string) (string, error) {
-	out, err := utils.SH(fmt.Sprintf("kube-vip manifest %s --interface %s --address %s --inCluster --taint --controlplane --arp --leaderElection %s", command, iface, ip, strings.Join(args, " ")))
+type kubeVIPEnv struct {
+	Name, Value, FieldPath string
+}
+
+type kubeVIPManifest struct {
+	Image        string
+	KubeConfig   string
+	StaticPod    bool
+	ControlPlane bool
+	Env          []kubeVIPEnv
+}
+
+func kubeVIPEnvironment(iface, ip string, kubeVIP providerConfig.KubeVIP) []kubeVIPEnv {
+	cidr := "32"
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		cidr = "128"
+	}
+
+	env := []kubeVIPEnv{
+		{Name: "vip_arp", Value: strconv.FormatBool(kubeVIP.IsARPEnabled())},
+		{Name: "port", Value: "6443"},
+		{Name: "vip_nodename", FieldPath: "spec.nodeName"},
+		{Name: "vip_interface", Value: iface},
+		{Name: "vip_cidr", Value: cidr},
+		{Name: "cp_enable", Value: strconv.FormatBool(kubeVIP.IsControlPlaneEnabled())},
+		{Name: "cp_namespace", Value: "kube-system"},
+		{Name: "svc_enable", Value: strconv.FormatBool(kubeVIP.IsLoadBalancerEnabled())},
+		{Name: "vip_leaderelection", Value: strconv.FormatBool(kubeVIP.IsLeaderElectionEnabled())},
+	}
+
+	if kubeVIP.IsLeaderElectionEnabled() {
+		env = append(env,
+			kubeVIPEnv{Name: "vip_leasename", Value: "plndr-cp-lock"},
+			kubeVIPEnv{Name: "vip_leaseduration", Value: "5"},
+			kubeVIPEnv{Name: "vip_renewdeadline", Value: "3"},
+			kubeVIPEnv{Name: "vip_retryperiod", Value: "1"},
+		)
+		if kubeVIP.IsLoadBalancerEnabled() {
+			env = append(env, kubeVIPEnv{Name: "svc_leasename", Value: "plndr-svcs-lock"})
+		}
+	}
+
+	if kubeVIP.BGP.Enable {
+		routerID := kubeVIP.BGP.RouterID
+		if routerID == "" {
+			routerID = interfaceIP(iface)
+		}
+		env = append(env,
+			kubeVIPEnv{Name: "bgp_enable", Value: "true"},
+			kubeVIPEnv{Name: "bgp_routerid", Value: routerID},
+			kubeVIPEnv{Name: "bgp_as", Value: strconv.FormatUint(uint64(kubeVIP.BGP.AS), 10)},
+			kubeVIPEnv{Name: "bgp_peers", Value: bgpPeers(kubeVIP.BGP)},
+		)
+	}
+
+	env = append(env, kubeVIPEnv{Name: "address", Value: ip})
+
+	// User-supplied variables take precedence over the generated ones, and
+	// kubevip.env over the deprecated kubevip.args. Args were validated with the config.
+	user, err := kubeVIP.ArgsEnv()
+	if err != nil {
+		user = map[string]string{}
+	}
+	for k, v := range kubeVIP.Env {
+		user[k] = v
+	}
+	names := make([]string, 0, len(user))
+	for k := range user {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		i := slices.IndexFunc(env, func(e kubeVIPEnv) bool { return e.Name == name })
+		if i == -1 {
+			env = append(env, kubeVIPEnv{Name: name, Value: user[name]})
+			continue
+		}
+		env[i] = kubeVIPEnv{Name: name, Value: user[name]}
+	}
+
+	return env
+}
+
+// bgpPeers returns the peers in the <address>:<AS>:<password>:<multihop> format expected by kube-vip.
+func bgpPeers(bgp providerConfig.KubeVIPBGP) string {
+	peers := []string{}
+	for _, p := range bgp.Peers {
+		as := p.AS
+		if as == 0 {
+			as = bgp.PeerAS
+		}
+		peers = append(peers, fmt.Sprintf("%s:%d:%s:%t", p.Address, as, p.Password, p.Multihop))
+	}
+	return strings.Join(peers, ",")
+}
+
+// kubeVIPRanges returns the kube-vip cloud provider ConfigMap entries for the configured Service ranges.
+func kubeVIPRanges(ranges map[string]string) map[string]string {
+	data := map[string]string{}
+	for ns, r := range ranges {
+		prefix := "range"
+		if _, _, err := net.ParseCIDR(strings.TrimSpace(strings.Split(r, ",")[0])); err == nil {
+			prefix = "cidr"
+		}
+		data[fmt.Sprintf("%s-%s", prefix, ns)] = strings.ReplaceAll(r, " ", "")
+	}
+	return data
+}
+
+func generateKubeVIPCloudProvider(pconfig *providerConfig.Config) (string, error) {
+	tmpl, err := template.ParseFS(assets.GetStaticFS(), "kube_vip_cloud_provider.yaml.tmpl")
+	if err != nil {
+		return "", fmt.Errorf("could not parse kube-vip cloud provider template: %w", err)
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, struct {
+		Image  string
+		Ranges map[string]string
+	}{
+		Image:  pconfig.KubeVIP.CloudProviderImageRef(),
+		Ranges: kubeVIPRanges(pconfig.KubeVIP.ServicesIPRanges),
+	}); err != nil {
+		return "", fmt.Errorf("could not render kube-vip cloud provider manifest: %w", err)
+	}
+
+	return out.String(), nil
+}
+
+func generateKubeVIP(iface, ip string, pconfig *providerConfig.Config) (string, error) {
+	tmpl, err := template.ParseFS(assets.GetStaticFS(), "kube_vip.yaml.tmpl")
+	if err != nil {
+		return "", fmt.Errorf("could not parse kube-vip template: %w", err)
+	}
+
+	_, kubeconfig := kubeVIPTarget(pconfig)
+
+	manifest := kubeVIPManifest{
+		Image:      pconfig.KubeVIP.ImageRef(),
+		KubeConfig: kubeconfig,
+		// the kubelet of agents only runs pods from the manifest directory
+		StaticPod:    pconfig.KubeVIP.StaticPod || pconfig.K3sAgent.Enabled,
+		ControlPlane: pconfig.KubeVIP.IsControlPlaneEnabled(),
+		Env:          kubeVIPEnvironment(iface, ip, pconfig.KubeVIP),
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, manifest); err != nil {
+		return "", fmt.Errorf("could not render kube-vip manifest: %w", err)
+	}
+
+	return out.String(), nil
+}
+
+var (
+	kubeVIPCacheDir        = "/usr/local/.kairos/state/kube-vip"
+	kubeVIPDownloadTimeout = 30 * time.Second
+)
+
+// maxManifestSize caps the size of a downloaded manifest.
+const maxManifestSize = 10 << 20
+
+// errInvalidManifest marks a manifest that was downloaded but can't be trusted. Unlike
+// an unreachable URL, it is never replaced by the cached or the embedded manifest.
+var errInvalidManifest = errors.New("invalid kube-vip manifest")
+
+func verifySHA256(data []byte, sum string) error {
+	if sum == "" {
+		return nil
+	}
+	actual := sha256.Sum256(data)
+	if !strings.EqualFold(hex.EncodeToString(actual[:]), strings.TrimSpace(sum)) {
+		return fmt.Errorf("checksum mismatch: expected %s, got %x", sum, actual)
+	}
+	return nil
+}
+
+func downloadFromURL(url, sum string) ([]byte, error) {
+	client := &http.Client{Timeout: kubeVIPDownloadTimeout}
+	response, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status downloading %s: %s", url, response.Status)
+	}
 
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxManifestSize+1))
 	if err != nil {
-		return "", fmt.Errorf("error: %w - %s", err, out)
+		return nil, err
+	}
+	if len(data) > maxManifestSize {
+		return nil, fmt.Errorf("%w: %s is larger than %d bytes", errInvalidManifest, url, maxManifestSize)
+	}
+
+	if err := verifySHA256(data, sum); err != nil {
+		return nil, fmt.Errorf("%w: could not verify %s: %w", errInvalidManifest, url, err)
 	}
 
-	return out, nil
+	return data, nil
 }
 
-func downloadFromURL(url, where string) error {
-	output, err := os.Create(where)
+func kubeVIPCacheFile(url string) string {
+	key := sha256.Sum256([]byte(url))
+	return filepath.Join(kubeVIPCacheDir, hex.EncodeToString(key[:])+".yaml")
+}
+
+// kubeVIPRBACManifest returns the kube-vip RBAC manifest. When an URL is configured it is downloaded
+// and cached, falling back to the last cached copy and then to the embedded manifest when it can't be
+// downloaded. A manifest that fails verification is an error.
+func kubeVIPRBACManifest(l log.StandardLogger, kubeVIP providerConfig.KubeVIP) ([]byte, error) {
+	if kubeVIP.ManifestURL != "" {
+		cacheFile := kubeVIPCacheFile(kubeVIP.ManifestURL)
+
+		data, err := downloadFromURL(kubeVIP.ManifestURL, kubeVIP.ManifestSHA256)
+		if err == nil {
+			if err := writeFileAtomic(cacheFile, data, 0600); err != nil {
+				l.Warnf("could not cache kube-vip manifest: %s", err.Error())
+			}
+			return data, nil
+		}
+		if errors.Is(err, errInvalidManifest) {
+			return nil, err
+		}
+		l.Warnf("could not download kube-vip manifest: %s", err.Error())
+
+		if data, err := os.ReadFile(cacheFile); err == nil {
+			if err := verifySHA256(data, kubeVIP.ManifestSHA256); err == nil {
+				l.Warnf("using cached kube-vip manifest from %s", cacheFile)
+				return data, nil
+			}
+		}
+		l.Warn("falling back to the embedded kube-vip manifest")
+	}
+
+	data, err := fs.ReadFile(assets.GetStaticFS(), "kube_vip_rbac.yaml")
 	if err != nil {
+		return nil, fmt.Errorf("could not find kube_vip in assets")
+	}
+	return data, nil
+}
+
+// writeFileAtomic writes to a temporary file first, so the target is never left truncated.
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
 		return err
 	}
-	defer output.Close()
 
-	response, err := http.Get(url)
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file))
 	if err != nil {
 		return err
+	}
+	defer os.Remove(tmp.Name())
 
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
 	}
-	defer response.Body.Close()
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// kubeVIPTarget returns the directory picked up by the enabled distribution to deploy
+// manifests, and the kubeconfig that a kube-vip static pod can use.
+func kubeVIPTarget(pconfig *providerConfig.Config) (manifestDirectory, kubeconfig string) {
+	switch {
+	case pconfig.IsK0sEnabled():
+		return "/var/lib/k0s/manifests/kube-vip/", "/var/lib/k0s/pki/admin.conf"
+	case pconfig.K3sAgent.Enabled:
+		return "/var/lib/rancher/k3s/agent/pod-manifests/", "/etc/rancher/k3s/k3s.yaml"
+	default:
+		return "/var/lib/rancher/k3s/server/manifests/", "/etc/rancher/k3s/k3s.yaml"
+	}
+}
 
-	_, err = io.Copy(output, response.Body)
-	return err
+// DeployKubeVIP deploys kube-vip on nodes bootstrapped without the P2P coordination,
+// where the VIP can only be the configured EIP.
+func DeployKubeVIP(l log.StandardLogger, pconfig *providerConfig.Config) error {
+	if pconfig.KubeVIP.EIP == "" {
+		return errors.New("kubevip.eip is required to deploy kube-vip")
+	}
+	iface, err := guessInterface(pconfig)
+	if err != nil {
+		return err
+	}
+	return deployKubeVIP(l, iface, pconfig.KubeVIP.EIP, pconfig)
 }
 
-func deployKubeVIP(iface, ip string, pconfig *providerConfig.Config) error {
-	manifestDirectory := "/var/lib/rancher/k3s/server/manifests/"
-	if pconfig.K3sAgent.Enabled {
-		manifestDirectory = "/var/lib/rancher/k3s/agent/pod-manifests/"
+func deployKubeVIP(l log.StandardLogger, iface, ip string, pconfig *providerConfig.Config) error {
+	if err := pconfig.KubeVIP.Validate(); err != nil {
+		return err
 	}
+
+	manifestDirectory, _ := kubeVIPTarget(pconfig)
 	if err := os.MkdirAll(manifestDirectory, 0650); err != nil {
 		return fmt.Errorf("could not create manifest dir")
 	}
@@ -52,46 +332,32 @@ func deployKubeVIP(iface, ip string, pconfig *providerConfig.Config) error {
 	targetFile := manifestDirectory + "kubevip.yaml"
 	targetCRDFile := manifestDirectory + "kubevipmanifest.yaml"
 
-	command := "daemonset"
-	if pconfig.KubeVIP.StaticPod {
-		command = "pod"
+	rbac, err := kubeVIPRBACManifest(l, pconfig.KubeVIP)
+	if err != nil {
+		return err
 	}
-
-	if pconfig.KubeVIP.ManifestURL != "" {
-		err := downloadFromURL(pconfig.KubeVIP.ManifestURL, targetCRDFile)
-		if err != nil {
-			return err
-		}
-	} else {
-		f, err := assets.GetStaticFS().Open("kube_vip_rbac.yaml")
-		if err != nil {
-			return fmt.Errorf("could not find kube_vip in assets")
-		}
-		defer f.Close()
-
-		destination, err := os.Create(targetCRDFile)
-		if err != nil {
-			return err
-		}
-		defer destination.Close()
-		_, err = io.Copy(destination, f)
-		if err != nil {
-			return err
-		}
+	if err := writeFileAtomic(targetCRDFile, rbac, 0600); err != nil {
+		return fmt.Errorf("could not write %s: %w", targetCRDFile, err)
 	}
 
-	content, err := generateKubeVIP(command, iface, ip, pconfig.KubeVIP.Args)
+	content, err := generateKubeVIP(iface, ip, pconfig)
 	if err != nil {
 		return fmt.Errorf("could not generate kubevip %s", err.Error())
 	}
 
-	f, err := os.Create(targetFile)
-	if err != nil {
-		return fmt.Errorf("could not open %s: %w", f.Name(), err)
+	if err := writeFileAtomic(targetFile, []byte(content), 0600); err != nil {
+		return fmt.Errorf("could not write %s: %w", targetFile, err)
 	}
-	defer f.Close()
-	if _, err := f.WriteString(content); err != nil {
-		return fmt.Errorf("could not write to %s: %w", f.Name(), err)
+
+	// Static pod directories only accept Pods, the cloud provider needs to be applied by the server
+	if len(pconfig.KubeVIP.ServicesIPRanges) > 0 && !pconfig.K3sAgent.Enabled {
+		content, err := generateKubeVIPCloudProvider(pconfig)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(manifestDirectory+"kubevip-cloud-provider.yaml", []byte(content), 0600); err != nil {
+			return fmt.Errorf("could not write kube-vip cloud provider manifest: %w", err)
+		}
 	}
 
 	return nil
@@ -0,0 +1,86 @@
+package role
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/kairos-io/provider-kairos/v2/internal/assets"
+	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("KubeVIP RBAC manifest", func() {
+	var (
+		server   *httptest.Server
+		status   int
+		body     string
+		embedded []byte
+	)
+
+	BeforeEach(func() {
+		var err error
+		kubeVIPCacheDir, err = os.MkdirTemp("", "kubevip")
+		Expect(err).ToNot(HaveOccurred())
+
+		embedded, err = fs.ReadFile(assets.GetStaticFS(), "kube_vip_rbac.yaml")
+		Expect(err).ToNot(HaveOccurred())
+
+		status, body = http.StatusOK, "kind: ServiceAccount\n"
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(status)
+			w.Write([]byte(body)) //nolint:errcheck
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(kubeVIPCacheDir)
+	})
+
+	sum := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+
+	It("downloads and verifies the manifest", func() {
+		data, err := kubeVIPRBACManifest(types.NewNullLogger(), providerConfig.KubeVIP{ManifestURL: server.URL, ManifestSHA256: sum(body)})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal(body))
+	})
+
+	It("never deploys an error page", func() {
+		status, body = http.StatusNotFound, "<html>not found</html>"
+		data, err := kubeVIPRBACManifest(types.NewNullLogger(), providerConfig.KubeVIP{ManifestURL: server.URL})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data).To(Equal(embedded))
+	})
+
+	It("rejects a manifest with a wrong checksum", func() {
+		_, err := kubeVIPRBACManifest(types.NewNullLogger(), providerConfig.KubeVIP{ManifestURL: server.URL, ManifestSHA256: sum("other")})
+		Expect(err).To(MatchError(ContainSubstring("checksum mismatch")))
+	})
+
+	It("rejects an oversize manifest", func() {
+		body = strings.Repeat("a", maxManifestSize+1)
+		_, err := kubeVIPRBACManifest(types.NewNullLogger(), providerConfig.KubeVIP{ManifestURL: server.URL})
+		Expect(err).To(MatchError(ContainSubstring("larger than")))
+	})
+
+	It("uses the cached copy when the URL is unreachable", func() {
+		k := providerConfig.KubeVIP{ManifestURL: server.URL, ManifestSHA256: sum(body)}
+		_, err := kubeVIPRBACManifest(types.NewNullLogger(), k)
+		Expect(err).ToNot(HaveOccurred())
+
+		server.Close()
+		data, err := kubeVIPRBACManifest(types.NewNullLogger(), k)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("kind: ServiceAccount\n"))
+	})
+})
@@ -0,0 +1,192 @@
+package role
+
+import (
+	"strings"
+
+	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gopkg.in/yaml.v3"
+)
+
+type renderedKubeVIP struct {
+	Kind string `yaml:"kind"`
+	Spec struct {
+		Containers []renderedContainer `yaml:"containers"`
+		Template   struct {
+			Spec struct {
+				ServiceAccountName string              `yaml:"serviceAccountName"`
+				Containers         []renderedContainer `yaml:"containers"`
+			} `yaml:"spec"`
+		} `yaml:"template"`
+	} `yaml:"spec"`
+}
+
+type renderedContainer struct {
+	Image string `yaml:"image"`
+	Env   []struct {
+		Name  string `yaml:"name"`
+		Value string `yaml:"value"`
+	} `yaml:"env"`
+}
+
+func (c renderedContainer) env() map[string]string {
+	m := map[string]string{}
+	for _, e := range c.Env {
+		m[e.Name] = e.Value
+	}
+	return m
+}
+
+var _ = Describe("KubeVIP", func() {
+	Context("manifest generation", func() {
+		It("renders a daemonset with the default options", func() {
+			out, err := generateKubeVIP("eth0", "192.168.1.10", &providerConfig.Config{})
+			Expect(err).ToNot(HaveOccurred())
+
+			r := renderedKubeVIP{}
+			Expect(yaml.Unmarshal([]byte(out), &r)).To(Succeed(), out)
+			Expect(r.Kind).To(Equal("DaemonSet"))
+			Expect(r.Spec.Template.Spec.ServiceAccountName).To(Equal("kube-vip"))
+			Expect(r.Spec.Template.Spec.Containers).To(HaveLen(1))
+
+			c := r.Spec.Template.Spec.Containers[0]
+			Expect(c.Image).To(Equal(providerConfig.DefaultKubeVIPImage + ":" + providerConfig.DefaultKubeVIPVersion))
+			Expect(c.env()).To(HaveKeyWithValue("vip_arp", "true"))
+			Expect(c.env()).To(HaveKeyWithValue("vip_leaderelection", "true"))
+			Expect(c.env()).To(HaveKeyWithValue("cp_enable", "true"))
+			Expect(c.env()).To(HaveKeyWithValue("svc_enable", "false"))
+			Expect(c.env()).To(HaveKeyWithValue("vip_interface", "eth0"))
+			Expect(c.env()).To(HaveKeyWithValue("address", "192.168.1.10"))
+		})
+
+		It("renders a static pod honoring typed options and env overrides", func() {
+			disabled := false
+			out, err := generateKubeVIP("eth1", "10.0.0.1", &providerConfig.Config{
+				KubeVIP: providerConfig.KubeVIP{
+					StaticPod: true,
+					Version:   "v0.7.0",
+					ARP:       &disabled,
+					Services:  true,
+					Env:       map[string]string{"vip_cidr": "24", "prometheus_server": ":2112"},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			r := renderedKubeVIP{}
+			Expect(yaml.Unmarshal([]byte(out), &r)).To(Succeed(), out)
+			Expect(r.Kind).To(Equal("Pod"))
+			Expect(r.Spec.Containers).To(HaveLen(1))
+
+			c := r.Spec.Containers[0]
+			Expect(c.Image).To(Equal(providerConfig.DefaultKubeVIPImage + ":v0.7.0"))
+			Expect(c.env()).To(HaveKeyWithValue("vip_arp", "false"))
+			Expect(c.env()).To(HaveKeyWithValue("svc_enable", "true"))
+			Expect(c.env()).To(HaveKeyWithValue("svc_leasename", "plndr-svcs-lock"))
+			Expect(c.env()).To(HaveKeyWithValue("vip_cidr", "24"))
+			Expect(c.env()).To(HaveKeyWithValue("prometheus_server", ":2112"))
+		})
+
+		It("translates the deprecated args, overridden by env", func() {
+			out, err := generateKubeVIP("eth0", "10.0.0.1", &providerConfig.Config{
+				KubeVIP: providerConfig.KubeVIP{
+					Args: []string{"--arp=false", "--services", "--lbPort 6444", "--inCluster"},
+					Env:  map[string]string{"lb_port": "6445"},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			r := renderedKubeVIP{}
+			Expect(yaml.Unmarshal([]byte(out), &r)).To(Succeed(), out)
+			c := r.Spec.Template.Spec.Containers[0]
+			Expect(c.env()).To(HaveKeyWithValue("vip_arp", "false"))
+			Expect(c.env()).To(HaveKeyWithValue("svc_enable", "true"))
+			Expect(c.env()).To(HaveKeyWithValue("lb_port", "6445"))
+		})
+
+		It("renders BGP mode", func() {
+			out, err := generateKubeVIP("eth0", "10.0.0.1", &providerConfig.Config{
+				KubeVIP: providerConfig.KubeVIP{
+					BGP: providerConfig.KubeVIPBGP{
+						Enable:   true,
+						RouterID: "192.168.1.2",
+						AS:       65000,
+						PeerAS:   65001,
+						Peers: []providerConfig.KubeVIPBGPPeer{
+							{Address: "192.168.1.1"},
+							{Address: "192.168.1.254", AS: 65002, Password: "secret", Multihop: true},
+						},
+					},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			r := renderedKubeVIP{}
+			Expect(yaml.Unmarshal([]byte(out), &r)).To(Succeed(), out)
+			c := r.Spec.Template.Spec.Containers[0]
+			Expect(c.env()).To(HaveKeyWithValue("vip_arp", "false"))
+			Expect(c.env()).To(HaveKeyWithValue("bgp_enable", "true"))
+			Expect(c.env()).To(HaveKeyWithValue("bgp_routerid", "192.168.1.2"))
+			Expect(c.env()).To(HaveKeyWithValue("bgp_as", "65000"))
+			Expect(c.env()).To(HaveKeyWithValue("bgp_peers", "192.168.1.1:65001::false,192.168.1.254:65002:secret:true"))
+		})
+
+		It("renders the cloud provider with per-namespace ranges", func() {
+			out, err := generateKubeVIPCloudProvider(&providerConfig.Config{
+				KubeVIP: providerConfig.KubeVIP{
+					ServicesIPRanges: map[string]string{
+						"global":  "192.168.1.220-192.168.1.230",
+						"default": "192.168.2.0/28",
+					},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			cm := struct {
+				Kind string            `yaml:"kind"`
+				Data map[string]string `yaml:"data"`
+			}{}
+			Expect(yaml.NewDecoder(strings.NewReader(out)).Decode(&cm)).To(Succeed(), out)
+			Expect(cm.Kind).To(Equal("ConfigMap"))
+			Expect(cm.Data).To(Equal(map[string]string{
+				"range-global": "192.168.1.220-192.168.1.230",
+				"cidr-default": "192.168.2.0/28",
+			}))
+		})
+	})
+
+	Context("validation", func() {
+		It("requires an AS and peers for BGP", func() {
+			k := providerConfig.KubeVIP{BGP: providerConfig.KubeVIPBGP{Enable: true}}
+			Expect(k.Validate()).To(HaveOccurred())
+
+			k.BGP.AS = 65000
+			k.BGP.Peers = []providerConfig.KubeVIPBGPPeer{{Address: "192.168.1.1", AS: 65001}}
+			Expect(k.Validate()).ToNot(HaveOccurred())
+		})
+
+		It("rejects BGP passwords breaking the peers format", func() {
+			k := providerConfig.KubeVIP{BGP: providerConfig.KubeVIPBGP{Enable: true, AS: 65000}}
+			for _, password := range []string{"a:b", "a,b"} {
+				k.BGP.Peers = []providerConfig.KubeVIPBGPPeer{{Address: "192.168.1.1", AS: 65001, Password: password}}
+				Expect(k.Validate()).To(MatchError("the password of kubevip.bgp peer '192.168.1.1' can't contain ':' or ','"))
+			}
+		})
+
+		It("rejects malformed service ranges", func() {
+			k := providerConfig.KubeVIP{ServicesIPRanges: map[string]string{"global": "192.168.1.1"}}
+			Expect(k.Validate()).To(HaveOccurred())
+
+			k.ServicesIPRanges["global"] = "192.168.1.0/24,192.168.1.1-192.168.1.2"
+			Expect(k.Validate()).To(HaveOccurred())
+		})
+
+		It("rejects deprecated args with no matching variable", func() {
+			k := providerConfig.KubeVIP{Args: []string{"--interface eth0", "--leaderElection"}}
+			Expect(k.Validate()).To(Succeed())
+
+			k.Args = append(k.Args, "--manifest=daemonset")
+			Expect(k.Validate()).To(MatchError(ContainSubstring("kubevip.args '--manifest=daemonset' is not supported anymore")))
+		})
+	})
+})
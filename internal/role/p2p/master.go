@@ -11,13 +11,14 @@ import (
 	"github.com/kairos-io/kairos-agent/v2/pkg/config"
 	"github.com/kairos-io/kairos-sdk/machine"
 	"github.com/kairos-io/kairos-sdk/utils"
+	"github.com/kairos-io/provider-kairos/v2/internal/metrics"
 	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
 	"github.com/kairos-io/provider-kairos/v2/internal/role"
 
 	service "github.com/mudler/edgevpn/api/client/service"
 )
 
-func propagateMasterData(ip string, c *service.RoleConfig, clusterInit, ha bool, role string) error {
+func propagateMasterData(ip, vip string, c *service.RoleConfig, pconfig *providerConfig.Config, clusterInit, ha bool, roleName string) error {
 	defer func() {
 		// Avoid polluting the API.
 		// The ledger already retries in the background to update the blockchain, but it has
@@ -28,7 +29,8 @@ func propagateMasterData(ip string, c *service.RoleConfig, clusterInit, ha bool,
 	}()
 
 	// If we are configured as master, always signal our role
-	if err := c.Client.Set("role", c.UUID, role); err != nil {
+	if err := c.Client.Set("role", c.UUID, roleName); err != nil {
+		metrics.LedgerError("set")
 		c.Logger.Error(err)
 		return err
 	}
@@ -46,8 +48,9 @@ func propagateMasterData(ip string, c *service.RoleConfig, clusterInit, ha bool,
 	nodeToken := string(tokenB)
 	nodeToken = strings.TrimRight(nodeToken, "\n")
 	if nodeToken != "" {
-		err := c.Client.Set("nodetoken", "token", nodeToken)
+		err := role.PublishNodeToken(c, pconfig, nodeToken)
 		if err != nil {
+			metrics.LedgerError("set")
 			c.Logger.Error(err)
 		}
 	}
@@ -58,29 +61,56 @@ func propagateMasterData(ip string, c *service.RoleConfig, clusterInit, ha bool,
 		return err
 	}
 	kubeconfig := string(kubeB)
-	if kubeconfig != "" {
+	// With admission, the kubeconfig would be readable by any node of the network
+	if kubeconfig != "" && !pconfig.P2P.Admission.Enable {
 		err := c.Client.Set("kubeconfig", "master", base64.RawURLEncoding.EncodeToString(kubeB))
 		if err != nil {
+			metrics.LedgerError("set")
 			c.Logger.Error(err)
 		}
 	}
 	err = c.Client.Set("master", "ip", ip)
 	if err != nil {
+		metrics.LedgerError("set")
 		c.Logger.Error(err)
 	}
+	if vip != "" {
+		if err := c.Client.Set("master", "vip", vip); err != nil {
+			metrics.LedgerError("set")
+			c.Logger.Error(err)
+		}
+	}
 	return nil
 }
 
-func genArgs(pconfig *providerConfig.Config, ip, ifaceIP string) (args []string) {
+// kubeVIPAddress returns the virtual IP fronting the API server, if any.
+func kubeVIPAddress(pconfig *providerConfig.Config) string {
+	if pconfig.KubeVIP.IsEnabled() {
+		return pconfig.KubeVIP.EIP
+	}
+	return ""
+}
+
+func genArgs(pconfig *providerConfig.Config, networkID, ip, ifaceIP string) (args []string) {
 
 	if pconfig.P2P.UseVPNWithKubernetes() {
-		args = append(args, "--flannel-iface=edgevpn0")
+		args = append(args, fmt.Sprintf("--flannel-iface=%s", VPNInterface(pconfig)))
 	}
 
 	if pconfig.KubeVIP.IsEnabled() {
 		args = append(args, fmt.Sprintf("--tls-san=%s", ip), fmt.Sprintf("--node-ip=%s", ifaceIP))
 	}
 
+	// The API server is reachable as api.<network-id> over the mesh DNS
+	if pconfig.P2P.DNS.IsEnabled() {
+		args = append(args, fmt.Sprintf("--tls-san=api.%s", networkID))
+	}
+
+	// kube-vip takes over LoadBalancer Services, disable the bundled one
+	if pconfig.KubeVIP.IsEnabled() && pconfig.KubeVIP.IsLoadBalancerEnabled() {
+		args = append(args, "--disable=servicelb")
+	}
+
 	if pconfig.K3s.EmbeddedRegistry {
 		args = append(args, "--embedded-registry")
 	}
@@ -88,11 +118,10 @@ func genArgs(pconfig *providerConfig.Config, ip, ifaceIP string) (args []string)
 	return
 }
 
-func genEnv(ha, clusterInit bool, c *service.Client, k3sConfig providerConfig.K3s) (env map[string]string) {
+func genEnv(ha, clusterInit bool, nodeToken string, k3sConfig providerConfig.K3s) (env map[string]string) {
 	env = make(map[string]string)
 
 	if ha && !clusterInit {
-		nodeToken, _ := c.Get("nodetoken", "token")
 		env["K3S_TOKEN"] = nodeToken
 	}
 
@@ -109,15 +138,14 @@ func genEnv(ha, clusterInit bool, c *service.Client, k3sConfig providerConfig.K3
 }
 
 // we either return the ElasticIP or the IP from the edgevpn interface.
-func guessIP(pconfig *providerConfig.Config) string {
+func guessIP(c *service.RoleConfig, pconfig *providerConfig.Config) string {
 	if pconfig.KubeVIP.EIP != "" {
 		return pconfig.KubeVIP.EIP
 	}
-	return utils.GetInterfaceIP("edgevpn0")
+	return vpnIP(c, pconfig)
 }
 
-func waitForMasterHAInfo(c *service.RoleConfig) bool {
-	nodeToken, _ := c.Client.Get("nodetoken", "token")
+func waitForMasterHAInfo(c *service.RoleConfig, nodeToken string) bool {
 	if nodeToken == "" {
 		c.Logger.Info("nodetoken not there still..")
 		return true
@@ -131,12 +159,14 @@ func waitForMasterHAInfo(c *service.RoleConfig) bool {
 	return false
 }
 
-func Master(cc *config.Config, pconfig *providerConfig.Config, clusterInit, ha bool, roleName string) role.Role { //nolint:revive
+func Master(cc *config.Config, pconfig *providerConfig.Config, networkID string, clusterInit, ha bool, roleName string) role.Role { //nolint:revive
 	return func(c *service.RoleConfig) error {
 
-		iface := guessInterface(pconfig)
-		ifaceIP := utils.GetInterfaceIP(iface)
-		ip := guessIP(pconfig)
+		iface, ifaceIP, err := nodeInterface(pconfig)
+		if err != nil {
+			return err
+		}
+		ip := guessIP(c, pconfig)
 		// If we don't have an IP, we sit and wait
 		if ip == "" {
 			return errors.New("node doesn't have an ip yet")
@@ -152,16 +182,21 @@ func Master(cc *config.Config, pconfig *providerConfig.Config, clusterInit, ha b
 
 		if role.SentinelExist() {
 			c.Logger.Info("Node already configured, backing off")
-			return propagateMasterData(ip, c, clusterInit, ha, roleName)
+			return propagateMasterData(ip, kubeVIPAddress(pconfig), c, pconfig, clusterInit, ha, roleName)
+		}
+
+		nodeToken, err := role.NodeToken(c, pconfig)
+		if err != nil {
+			return err
 		}
 
-		if ha && !clusterInit && waitForMasterHAInfo(c) {
+		if ha && !clusterInit && waitForMasterHAInfo(c, nodeToken) {
 			return nil
 		}
 
 		k3sConfig := pconfig.K3s
 
-		env := genEnv(ha, clusterInit, c.Client, k3sConfig)
+		env := genEnv(ha, clusterInit, nodeToken, k3sConfig)
 
 		// Configure k3s service to start on edgevpn0
 		c.Logger.Info("Configuring k3s")
@@ -179,9 +214,9 @@ func Master(cc *config.Config, pconfig *providerConfig.Config, clusterInit, ha b
 			return fmt.Errorf("failed to write the k3s service: %w", err)
 		}
 
-		args := genArgs(pconfig, ip, ifaceIP)
+		args := genArgs(pconfig, networkID, ip, ifaceIP)
 		if pconfig.KubeVIP.IsEnabled() {
-			if err := deployKubeVIP(iface, ip, pconfig); err != nil {
+			if err := deployKubeVIP(c.Logger, iface, ip, pconfig); err != nil {
 				return fmt.Errorf("failed KubeVIP setup: %w", err)
 			}
 		}
@@ -222,7 +257,7 @@ func Master(cc *config.Config, pconfig *providerConfig.Config, clusterInit, ha b
 			return fmt.Errorf("failed to enable k3s service: %w", err)
 		}
 
-		if err := propagateMasterData(ip, c, clusterInit, ha, roleName); err != nil {
+		if err := propagateMasterData(ip, kubeVIPAddress(pconfig), c, pconfig, clusterInit, ha, roleName); err != nil {
 			return fmt.Errorf("failed to propagate master data: %w", err)
 		}
 
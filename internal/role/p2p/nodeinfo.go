@@ -0,0 +1,36 @@
+package role
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/kairos-io/provider-kairos/v2/internal/cluster"
+	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
+	"github.com/kairos-io/provider-kairos/v2/internal/role"
+
+	service "github.com/mudler/edgevpn/api/client/service"
+)
+
+// NodeInfo publishes the hostname, VPN address and bootstrap state of the node,
+// as shown by the cluster status.
+func NodeInfo(pconfig *providerConfig.Config) role.Role { //nolint:revive
+	return func(c *service.RoleConfig) error {
+		info := cluster.NodeInfo{Configured: role.SentinelExist()}
+		info.Hostname, _ = os.Hostname()
+		if pconfig.P2P.VPNNeedsCreation() {
+			info.VPNIP = interfaceIP(VPNInterface(pconfig))
+		}
+		if pconfig.P2P.Auto.HA.IsEnabled() && pconfig.P2P.Auto.HA.MasterNodes != nil {
+			info.HATarget = *pconfig.P2P.Auto.HA.MasterNodes
+		}
+
+		dat, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		if published, _ := c.Client.Get(cluster.NodeInfoKey, c.UUID); published == string(dat) {
+			return nil
+		}
+		return c.Client.Set(cluster.NodeInfoKey, c.UUID, string(dat))
+	}
+}
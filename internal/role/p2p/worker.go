@@ -3,8 +3,11 @@ package role
 import (
 	"errors"
 	"fmt"
+	"os"
 	"strings"
+	"time"
 
+	"github.com/joho/godotenv"
 	"github.com/kairos-io/kairos-agent/v2/pkg/config"
 	"github.com/kairos-io/kairos-sdk/machine"
 	"github.com/kairos-io/kairos-sdk/utils"
@@ -12,9 +15,12 @@ import (
 	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
 	"github.com/kairos-io/provider-kairos/v2/internal/role"
 	service "github.com/mudler/edgevpn/api/client/service"
+	"gopkg.in/yaml.v3"
 )
 
 func Worker(cc *config.Config, pconfig *providerConfig.Config) role.Role { //nolint:revive
+	watch := &masterWatch{}
+
 	return func(c *service.RoleConfig) error {
 
 		if pconfig.P2P.Role != "" {
@@ -27,6 +33,19 @@ func Worker(cc *config.Config, pconfig *providerConfig.Config) role.Role { //nol
 
 		if role.SentinelExist() {
 			c.Logger.Info("Node already configured, backing off")
+			if err := reconcileNodeIP(c, pconfig); err != nil {
+				return err
+			}
+			return reconcileMasterIP(c, pconfig, watch)
+		}
+
+		if !role.Admitted(c.Client, pconfig, c.UUID) {
+			c.Logger.Info("Node not admitted to the network yet, waiting for approval")
+			return nil
+		}
+
+		if !role.AdmittedMaster(c.Client, pconfig) {
+			c.Logger.Info("No admitted master yet..")
 			return nil
 		}
 
@@ -36,7 +55,10 @@ func Worker(cc *config.Config, pconfig *providerConfig.Config) role.Role { //nol
 			return nil
 		}
 
-		nodeToken, _ := c.Client.Get("nodetoken", "token")
+		nodeToken, err := role.NodeToken(c, pconfig)
+		if err != nil {
+			return err
+		}
 		if nodeToken == "" {
 			c.Logger.Info("node token not there still..")
 			return nil
@@ -49,13 +71,10 @@ func Worker(cc *config.Config, pconfig *providerConfig.Config) role.Role { //nol
 			return err
 		}
 
-		k3sConfig := providerConfig.K3s{}
-		if pconfig.K3sAgent.Enabled {
-			k3sConfig = pconfig.K3sAgent
-		}
+		k3sConfig := workerK3sConfig(pconfig)
 
 		env := map[string]string{
-			"K3S_URL":   fmt.Sprintf("https://%s:6443", masterIP),
+			"K3S_URL":   masterURL(masterIP),
 			"K3S_TOKEN": nodeToken,
 		}
 
@@ -73,16 +92,27 @@ func Worker(cc *config.Config, pconfig *providerConfig.Config) role.Role { //nol
 		}
 
 		if pconfig.P2P.UseVPNWithKubernetes() {
-			ip := utils.GetInterfaceIP("edgevpn0")
+			ip := vpnIP(c, pconfig)
 			if ip == "" {
 				return errors.New("node doesn't have an ip yet")
 			}
-			args = append(args,
-				fmt.Sprintf("--node-ip %s", ip),
-				"--flannel-iface=edgevpn0")
+			args = append(args, fmt.Sprintf("--flannel-iface=%s", VPNInterface(pconfig)))
+			// The address from the pool can still move, keep it where it can be updated
+			if usesAddressPool(pconfig) && !k3sConfig.ReplaceArgs {
+				if err := writeNodeIPConfig(k3sNodeIPConfig, ip); err != nil {
+					return err
+				}
+			} else {
+				args = append(args, fmt.Sprintf("--node-ip %s", ip))
+			}
 		} else {
-			iface := guessInterface(pconfig)
-			ip := utils.GetInterfaceIP(iface)
+			_, ip, err := nodeInterface(pconfig)
+			if err != nil {
+				return err
+			}
+			if ip == "" {
+				return errors.New("could not detect the node ip")
+			}
 			args = append(args,
 				fmt.Sprintf("--node-ip %s", ip))
 		}
@@ -125,3 +155,151 @@ func Worker(cc *config.Config, pconfig *providerConfig.Config) role.Role { //nol
 		return role.CreateSentinel()
 	}
 }
+
+func workerK3sConfig(pconfig *providerConfig.Config) providerConfig.K3s {
+	if pconfig.K3sAgent.Enabled {
+		return pconfig.K3sAgent
+	}
+	return providerConfig.K3s{}
+}
+
+// k3sNodeIPConfig is a k3s configuration file holding the node address,
+// for nodes whose VPN address can be moved after k3s was configured.
+const k3sNodeIPConfig = "/etc/rancher/k3s/config.yaml.d/90-kairos-node-ip.yaml"
+
+func writeNodeIPConfig(file, ip string) error {
+	dat, err := yaml.Marshal(map[string]string{"node-ip": ip})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, dat, 0600)
+}
+
+func readNodeIPConfig(file string) (string, error) {
+	dat, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	cfg := map[string]string{}
+	if err := yaml.Unmarshal(dat, &cfg); err != nil {
+		return "", fmt.Errorf("could not parse %s: %w", file, err)
+	}
+	return cfg["node-ip"], nil
+}
+
+// reconcileNodeIP updates the node address of an already configured k3s-agent
+// when the vpn/address role moved the node to another VPN address.
+func reconcileNodeIP(c *service.RoleConfig, pconfig *providerConfig.Config) error {
+	if !pconfig.P2P.UseVPNWithKubernetes() || !usesAddressPool(pconfig) {
+		return nil
+	}
+
+	current, err := readNodeIPConfig(k3sNodeIPConfig)
+	if os.IsNotExist(err) {
+		// The node address is part of the k3s-agent arguments
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	ip := vpnIP(c, pconfig)
+	if ip == "" || ip == current {
+		return nil
+	}
+
+	c.Logger.Infof("VPN address moved from '%s' to '%s', reconfiguring k3s-agent", current, ip)
+
+	if err := writeNodeIPConfig(k3sNodeIPConfig, ip); err != nil {
+		return err
+	}
+
+	svc, err := machine.K3sAgent()
+	if err != nil {
+		return err
+	}
+
+	if err := svc.Restart(); err != nil {
+		return fmt.Errorf("failed to restart k3s-agent: %w", err)
+	}
+	return nil
+}
+
+func masterURL(ip string) string {
+	return fmt.Sprintf("https://%s:6443", ip)
+}
+
+// masterWatch keeps track of a master IP change seen in the ledger
+// which is not yet applied to the local k3s-agent.
+type masterWatch struct {
+	ip    string
+	since time.Time
+}
+
+// observe records ip as the currently published master IP and returns
+// true once it was observed for at least the debounce period.
+func (w *masterWatch) observe(ip string, now time.Time, debounce time.Duration) bool {
+	if w.ip != ip {
+		w.ip = ip
+		w.since = now
+	}
+	return now.Sub(w.since) >= debounce
+}
+
+func (w *masterWatch) reset() {
+	w.ip = ""
+	w.since = time.Time{}
+}
+
+// reconcileMasterIP points an already configured k3s-agent to the master IP
+// currently published in the ledger, restarting the agent if it changed.
+func reconcileMasterIP(c *service.RoleConfig, pconfig *providerConfig.Config, watch *masterWatch) error {
+	k3sConfig := workerK3sConfig(pconfig)
+	if _, pinned := k3sConfig.Env["K3S_URL"]; pinned || k3sConfig.ReplaceEnv {
+		// The user manages the server URL, nothing to reconcile
+		return nil
+	}
+
+	masterIP, _ := c.Client.Get("master", "ip")
+	if masterIP == "" {
+		return nil
+	}
+
+	envFile := machine.K3sEnvUnit("k3s-agent")
+	env, err := godotenv.Read(envFile)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", envFile, err)
+	}
+
+	if env["K3S_URL"] == masterURL(masterIP) {
+		watch.reset()
+		return nil
+	}
+
+	debounce, err := pconfig.P2P.MasterChangeDebounceDuration()
+	if err != nil {
+		return err
+	}
+	if !watch.observe(masterIP, time.Now(), debounce) {
+		c.Logger.Infof("Master IP changed from '%s' to '%s', waiting %s before reconfiguring", env["K3S_URL"], masterIP, debounce)
+		return nil
+	}
+
+	c.Logger.Infof("Master IP changed to '%s', reconfiguring k3s-agent", masterIP)
+
+	if err := utils.WriteEnv(envFile, map[string]string{"K3S_URL": masterURL(masterIP)}); err != nil {
+		return err
+	}
+
+	svc, err := machine.K3sAgent()
+	if err != nil {
+		return err
+	}
+
+	if err := svc.Restart(); err != nil {
+		return fmt.Errorf("failed to restart k3s-agent: %w", err)
+	}
+
+	watch.reset()
+	return nil
+}
@@ -0,0 +1,58 @@
+package role
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Worker", func() {
+	Context("master IP changes", func() {
+		It("waits for the debounce period before applying a new IP", func() {
+			w := &masterWatch{}
+			now := time.Now()
+
+			Expect(w.observe("10.1.0.2", now, time.Minute)).To(BeFalse())
+			Expect(w.observe("10.1.0.2", now.Add(30*time.Second), time.Minute)).To(BeFalse())
+			Expect(w.observe("10.1.0.2", now.Add(time.Minute), time.Minute)).To(BeTrue())
+		})
+
+		It("restarts the debounce when the IP flaps", func() {
+			w := &masterWatch{}
+			now := time.Now()
+
+			Expect(w.observe("10.1.0.2", now, time.Minute)).To(BeFalse())
+			Expect(w.observe("10.1.0.3", now.Add(50*time.Second), time.Minute)).To(BeFalse())
+			Expect(w.observe("10.1.0.3", now.Add(70*time.Second), time.Minute)).To(BeFalse())
+			Expect(w.observe("10.1.0.3", now.Add(110*time.Second), time.Minute)).To(BeTrue())
+		})
+
+		It("rejects an invalid debounce", func() {
+			Expect(providerConfig.P2P{}.MasterChangeDebounceDuration()).To(Equal(2 * time.Minute))
+			Expect(providerConfig.P2P{MasterChangeDebounce: "30s"}.MasterChangeDebounceDuration()).To(Equal(30 * time.Second))
+			_, err := providerConfig.P2P{MasterChangeDebounce: "2 minutes"}.MasterChangeDebounceDuration()
+			Expect(err).To(MatchError(ContainSubstring("invalid p2p.master_change_debounce '2 minutes'")))
+		})
+	})
+
+	Context("VPN address moves", func() {
+		It("keeps the node IP in a k3s configuration file", func() {
+			dir, err := os.MkdirTemp("", "k3s")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+
+			file := filepath.Join(dir, "config.yaml.d", "90-kairos-node-ip.yaml")
+			Expect(writeNodeIPConfig(file, "10.1.0.2")).To(Succeed())
+			Expect(writeNodeIPConfig(file, "10.1.0.3")).To(Succeed())
+
+			ip, err := readNodeIPConfig(file)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ip).To(Equal("10.1.0.3"))
+		})
+	})
+})
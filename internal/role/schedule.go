@@ -5,13 +5,17 @@ import (
 	"math/rand"
 
 	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/provider-kairos/v2/internal/metrics"
 	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
 	"github.com/mudler/edgevpn/api/client/service"
 	"github.com/samber/lo"
 )
 
 // scheduleRoles assigns roles to nodes. Meant to be called only by leaders.
+// Nodes which are not admitted are ignored.
 func scheduleRoles(nodes []string, c *service.RoleConfig, cc *config.Config, pconfig *providerConfig.Config) error { //nolint:revive
+	nodes = AdmittedNodes(c.Client, pconfig, nodes)
+
 	// Assign roles to nodes
 	unassignedNodes, currentRoles := getRoles(c.Client, nodes)
 	c.Logger.Infof("I'm the leader. My UUID is: %s.\n Current assigned roles: %+v", c.UUID, currentRoles)
@@ -23,6 +27,7 @@ func scheduleRoles(nodes []string, c *service.RoleConfig, cc *config.Config, pco
 			if !lo.Contains(advertizing, u) {
 				c.Logger.Infof("Role '%s' assigned to unreachable node '%s'. Unassigning.", u, r)
 				if err := c.Client.Delete("role", u); err != nil {
+					metrics.LedgerError("delete")
 					c.Logger.Warnf("Error announcing deletion %+v", err)
 				}
 				// Return here to propagate announces and wait until the map is pruned
@@ -76,6 +81,7 @@ func scheduleRoles(nodes []string, c *service.RoleConfig, cc *config.Config, pco
 		}
 
 		if err := c.Client.Set("role", selected, masterRole); err != nil {
+			metrics.LedgerError("set")
 			return err
 		}
 		c.Logger.Infof("-> Set %s to %s", masterRole, selected)
@@ -88,6 +94,7 @@ func scheduleRoles(nodes []string, c *service.RoleConfig, cc *config.Config, pco
 	if pconfig.P2P.Auto.HA.IsEnabled() && pconfig.P2P.Auto.HA.MasterNodes != nil && *pconfig.P2P.Auto.HA.MasterNodes != mastersHA {
 		if len(unassignedNodes) > 0 {
 			if err := c.Client.Set("role", unassignedNodes[0], masterHA); err != nil {
+				metrics.LedgerError("set")
 				c.Logger.Error(err)
 				return err
 			}
@@ -100,6 +107,7 @@ func scheduleRoles(nodes []string, c *service.RoleConfig, cc *config.Config, pco
 	// cycle all empty roles and assign worker roles
 	for _, uuid := range unassignedNodes {
 		if err := c.Client.Set("role", uuid, workerRole); err != nil {
+			metrics.LedgerError("set")
 			c.Logger.Error(err)
 			return err
 		}
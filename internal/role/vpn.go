@@ -0,0 +1,143 @@
+package role
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/kairos-io/kairos-sdk/utils"
+	providerConfig "github.com/kairos-io/provider-kairos/v2/internal/provider/config"
+	"github.com/kairos-io/provider-kairos/v2/internal/services"
+
+	service "github.com/mudler/edgevpn/api/client/service"
+)
+
+// PoolAddress derives the VPN address of a node from its UUID within the pool,
+// skipping the addresses already taken by other nodes. The address is returned in CIDR notation.
+func PoolAddress(pool, uuid string, taken map[string]bool) (string, error) {
+	_, network, err := net.ParseCIDR(pool)
+	if err != nil {
+		return "", err
+	}
+	base := network.IP.To4()
+	if base == nil {
+		return "", fmt.Errorf("address pool '%s' is not IPv4", pool)
+	}
+
+	ones, bits := network.Mask.Size()
+	if bits-ones < 2 {
+		return "", fmt.Errorf("address pool '%s' is too small", pool)
+	}
+	// Network and broadcast addresses are not usable
+	usable := (uint64(1) << (bits - ones)) - 2
+
+	sum := sha256.Sum256([]byte(uuid))
+	offset := binary.BigEndian.Uint64(sum[:8]) % usable
+
+	for i := uint64(0); i < usable; i++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(base)+uint32(1+(offset+i)%usable))
+		if !taken[ip.String()] {
+			return fmt.Sprintf("%s/%d", ip, ones), nil
+		}
+	}
+
+	return "", fmt.Errorf("no free address left in pool '%s'", pool)
+}
+
+// InPool reports whether the address (with or without prefix length) belongs to the pool.
+func InPool(pool, address string) bool {
+	_, network, err := net.ParseCIDR(pool)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(strings.Split(address, "/")[0])
+	return ip != nil && network.Contains(ip)
+}
+
+// vpnAddressClaims returns the VPN addresses published by the other nodes, and whether
+// a node with a lower UUID claims the given one, which then has precedence over this node.
+func vpnAddressClaims(c *service.RoleConfig, ip string) (map[string]bool, bool) {
+	nodes, _ := c.Client.AdvertizingNodes()
+	taken := map[string]bool{}
+	conflict := false
+	for _, n := range nodes {
+		if n == c.UUID {
+			continue
+		}
+		claimed, _ := c.Client.Get("vpnaddress", n)
+		if claimed == "" {
+			continue
+		}
+		taken[claimed] = true
+		if claimed == ip && n < c.UUID {
+			conflict = true
+		}
+	}
+	return taken, conflict
+}
+
+// VPNAddressSettled reports whether ip is the VPN address published by the node, with no
+// conflicting claim. Kubernetes must only be configured on it once settled, as the
+// address is not going to be moved anymore by VPNAddress.
+func VPNAddressSettled(c *service.RoleConfig, ip string) bool {
+	published, _ := c.Client.Get("vpnaddress", c.UUID)
+	if published == "" || published != ip {
+		return false
+	}
+	_, conflict := vpnAddressClaims(c, ip)
+	return !conflict
+}
+
+// VPNAddress publishes the VPN address of nodes using an address pool, and moves
+// the node to a free address when another node with a lower UUID claims the same one.
+func VPNAddress(pconfig *providerConfig.Config) Role { //nolint:revive
+	return func(c *service.RoleConfig) error {
+		pool := pconfig.P2P.VPN.AddressPool
+		envFile := services.EdgeVPNEnvFile(services.EdgeVPNDefaultInstance)
+
+		env, err := godotenv.Read(envFile)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", envFile, err)
+		}
+		current := strings.Split(env["ADDRESS"], "/")[0]
+		if current == "" {
+			return errors.New("no VPN address configured")
+		}
+
+		taken, conflict := vpnAddressClaims(c, current)
+		if !conflict {
+			published, _ := c.Client.Get("vpnaddress", c.UUID)
+			if published != current {
+				return c.Client.Set("vpnaddress", c.UUID, current)
+			}
+			return nil
+		}
+
+		taken[current] = true
+		address, err := PoolAddress(pool, c.UUID, taken)
+		if err != nil {
+			return err
+		}
+
+		c.Logger.Infof("VPN address %s already taken, moving to %s", current, address)
+
+		if err := utils.WriteEnv(envFile, map[string]string{"ADDRESS": address}); err != nil {
+			return err
+		}
+
+		if err := c.Client.Set("vpnaddress", c.UUID, strings.Split(address, "/")[0]); err != nil {
+			c.Logger.Error(err)
+		}
+
+		svc, err := services.EdgeVPN(services.EdgeVPNDefaultInstance, "/")
+		if err != nil {
+			return err
+		}
+		return svc.Restart()
+	}
+}
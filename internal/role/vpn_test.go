@@ -0,0 +1,44 @@
+package role_test
+
+import (
+	. "github.com/kairos-io/provider-kairos/v2/internal/role"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("VPN address pool", func() {
+	It("derives a stable address from the UUID", func() {
+		a, err := PoolAddress("10.1.0.0/24", "node-a", nil)
+		Expect(err).ToNot(HaveOccurred())
+		b, err := PoolAddress("10.1.0.0/24", "node-a", nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(a).To(Equal(b))
+		Expect(a).To(HaveSuffix("/24"))
+		Expect(InPool("10.1.0.0/24", a)).To(BeTrue())
+	})
+
+	It("skips taken addresses", func() {
+		a, err := PoolAddress("10.1.0.0/24", "node-a", nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		ip := a[:len(a)-len("/24")]
+		b, err := PoolAddress("10.1.0.0/24", "node-a", map[string]bool{ip: true})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(b).ToNot(Equal(a))
+		Expect(InPool("10.1.0.0/24", b)).To(BeTrue())
+	})
+
+	It("never hands out the network or broadcast address", func() {
+		taken := map[string]bool{}
+		for i := 0; i < 2; i++ {
+			a, err := PoolAddress("10.1.0.0/30", "node-a", taken)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(a).To(BeElementOf("10.1.0.1/30", "10.1.0.2/30"))
+			taken[a[:len(a)-len("/30")]] = true
+		}
+
+		_, err := PoolAddress("10.1.0.0/30", "node-a", taken)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -1,6 +1,8 @@
 package services
 
 import (
+	"fmt"
+
 	"github.com/kairos-io/kairos-sdk/machine"
 	"github.com/kairos-io/kairos-sdk/machine/openrc"
 	"github.com/kairos-io/kairos-sdk/machine/systemd"
@@ -11,18 +13,18 @@ const edgevpnOpenRC string = `#!/sbin/openrc-run
 
 depend() {
 	after net
-	provide edgevpn
+	provide %[1]s
 }
 
 supervisor=supervise-daemon
-name="edgevpn"
+name="%[1]s"
 command="edgevpn"
-supervise_daemon_args="--stdout /var/log/edgevpn.log --stderr /var/log/edgevpn.log"
-pidfile="/run/edgevpn.pid"
+supervise_daemon_args="--stdout /var/log/%[1]s.log --stderr /var/log/%[1]s.log"
+pidfile="/run/%[1]s.pid"
 respawn_delay=5
 set -o allexport
 if [ -f /etc/environment ]; then source /etc/environment; fi
-if [ -f /etc/systemd/system.conf.d/edgevpn-kairos.env ]; then source /etc/systemd/system.conf.d/edgevpn-kairos.env; fi
+if [ -f %[2]s ]; then source %[2]s; fi
 set +o allexport`
 
 const edgevpnAPIOpenRC string = `#!/sbin/openrc-run
@@ -68,11 +70,26 @@ WantedBy=multi-user.target`
 
 const EdgeVPNDefaultInstance string = "kairos"
 
+// EdgeVPNEnvFile returns the environment file read by an edgevpn instance.
+func EdgeVPNEnvFile(instance string) string {
+	return fmt.Sprintf("/etc/systemd/system.conf.d/edgevpn-%s.env", instance)
+}
+
+// edgeVPNOpenRCName keeps the default instance service named "edgevpn",
+// while additional instances get their own service.
+func edgeVPNOpenRCName(instance string) string {
+	if instance == EdgeVPNDefaultInstance {
+		return "edgevpn"
+	}
+	return fmt.Sprintf("edgevpn-%s", instance)
+}
+
 func EdgeVPN(instance, rootDir string) (machine.Service, error) {
 	if utils.IsOpenRCBased() {
+		name := edgeVPNOpenRCName(instance)
 		return openrc.NewService(
-			openrc.WithName("edgevpn"),
-			openrc.WithUnitContent(edgevpnOpenRC),
+			openrc.WithName(name),
+			openrc.WithUnitContent(fmt.Sprintf(edgevpnOpenRC, name, EdgeVPNEnvFile(instance))),
 			openrc.WithRoot(rootDir),
 		)
 	}